@@ -22,6 +22,10 @@ func (x *APIUsageCommand) Register(parser *flags.Parser, config *foxess.Config)
 	x.config = config
 }
 
+func (x *APIUsageCommand) RequiresAPIKey() bool {
+	return true
+}
+
 func (x *APIUsageCommand) Execute(_ []string) error {
 	apiUsage, err := x.config.GetAPIUsage()
 	if err != nil {
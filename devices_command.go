@@ -23,6 +23,10 @@ func (x *DevicesCommand) Register(parser *flags.Parser, config *foxess.Config) {
 	x.config = config
 }
 
+func (x *DevicesCommand) RequiresAPIKey() bool {
+	return true
+}
+
 func (x *DevicesCommand) Execute(_ []string) error {
 	if x.Format == FormatJSON && x.FullOutput {
 		return fmt.Errorf("%w: %s", ErrInvalidArgument, "full output is not supported for JSON format")
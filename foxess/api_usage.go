@@ -6,8 +6,8 @@ import (
 )
 
 type AccessCountResponse struct {
-	ErrorNumber int `json:"errno"`
-	Result      struct {
+	Response
+	Result struct {
 		Total     json.Number `json:"total"`
 		Remaining json.Number `json:"remaining"`
 	} `json:"result"`
@@ -29,10 +29,6 @@ func (api *Config) GetAPIUsage() (*APIUsage, error) {
 		return nil, fmt.Errorf("failed to get latest api usage: %w", err)
 	}
 
-	if err = isError(response.ErrorNumber, ""); err != nil {
-		return nil, err
-	}
-
 	total, err := response.Result.Total.Float64()
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert to float '%v': %w", response.Result.Total, err)
@@ -12,14 +12,53 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/teh-hippo/foxess-exporter/util"
 )
 
+const baseURL = "https://www.foxesscloud.com"
+
+const (
+	OutcomeSuccess        = "success"
+	OutcomeErrorResponse  = "error_response"
+	OutcomeRequestFailure = "request_failure"
+	OutcomeParseFailure   = "parse_failure"
+)
+
+// RequestEvent describes a completed call to the FoxESS API.
+type RequestEvent struct {
+	Method       string
+	Path         string
+	Outcome      string
+	ErrorNumber  int
+	ResponseSize int64
+	Duration     time.Duration
+	Err          error
+}
+
+type RequestHook func(event *RequestEvent)
+
 type Config struct {
-	APIKey string `short:"k" long:"api-key" description:"FoxESS API Key"      env:"API_KEY" required:"true"`
-	Debug  bool   `short:"d" long:"debug"   description:"Enable debug output" env:"DEBUG"`
+	APIKey        string       `short:"k" long:"api-key"     description:"FoxESS API Key, required to call FoxESS" env:"API_KEY"`
+	Debug         bool         `short:"d" long:"debug"       description:"Enable debug output"                    env:"DEBUG"`
+	APIVersion    string       `short:"a" long:"api-version" description:"Real-time API version (auto, v0 or v1)" env:"API_VERSION" default:"auto" choice:"auto" choice:"v0" choice:"v1"`
+	Client        *http.Client `no-flag:"true"` // Sends the requests, or http.DefaultClient when nil.
+	legacyDevices sync.Map
+	hooks         []RequestHook
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+
+	return n, err //nolint:wrapcheck
 }
 
 type CustomTime struct {
@@ -34,11 +73,42 @@ type ParamHolder interface {
 	apiKey() string
 }
 
+type Response struct {
+	ErrorNumber int    `json:"errno"`
+	Message     string `json:"msg"`
+}
+
+type responseHolder interface {
+	response() *Response
+}
+
+type streamDecoder interface {
+	decodeStream(decoder *json.Decoder) error
+}
+
 var ErrFoxessErrorResponse = errors.New("error response from foxess")
 
+func (r *Response) response() *Response {
+	return r
+}
+
+// ResponseError is returned when FoxESS responds with a non-zero errno.
+type ResponseError struct {
+	ErrorNumber int
+	Message     string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%d %v: %s", e.ErrorNumber, ErrFoxessErrorResponse, e.Message)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return ErrFoxessErrorResponse
+}
+
 func isError(errorNumber int, message string) error {
 	if errorNumber != 0 {
-		return fmt.Errorf("%d %w: %s", errorNumber, ErrFoxessErrorResponse, message)
+		return &ResponseError{ErrorNumber: errorNumber, Message: message}
 	}
 
 	return nil
@@ -81,7 +151,37 @@ func CalculateSignature(path, apiKey string, timestamp int64) string {
 }
 
 func (api *Config) NewRequest(operation, path string, params, result interface{}) error {
-	url := "https://www.foxesscloud.com" + path
+	event := &RequestEvent{
+		Method:       operation,
+		Path:         path,
+		Outcome:      OutcomeSuccess,
+		ErrorNumber:  0,
+		ResponseSize: 0,
+		Duration:     0,
+		Err:          nil,
+	}
+	start := time.Now()
+
+	err := api.doRequest(operation, path, params, result, event)
+
+	event.Duration = time.Since(start)
+	event.Err = err
+
+	for _, hook := range api.hooks {
+		hook(event)
+	}
+
+	return err
+}
+
+// AddRequestHook registers a hook that observes every request made with this configuration. Hooks must be added
+// before any requests are made.
+func (api *Config) AddRequestHook(hook RequestHook) {
+	api.hooks = append(api.hooks, hook)
+}
+
+func (api *Config) doRequest(operation, path string, params, result interface{}, event *RequestEvent) error {
+	url := baseURL + path
 	timestamp := time.Now().UnixMilli()
 	signature := CalculateSignature(path, api.APIKey, timestamp)
 	operationParts := strings.Split(operation, "/")
@@ -92,6 +192,8 @@ func (api *Config) NewRequest(operation, path string, params, result interface{}
 		err  error
 	)
 
+	event.Outcome = OutcomeRequestFailure
+
 	if params != nil {
 		body, err = util.ToReader(params)
 		if err != nil {
@@ -110,42 +212,143 @@ func (api *Config) NewRequest(operation, path string, params, result interface{}
 	request.Header.Set("Lang", "en")
 	request.Header.Set("Content-Type", "application/json")
 
-	response, err := http.DefaultClient.Do(request)
+	response, err := api.client().Do(request)
 	if err != nil {
 		return fmt.Errorf("failed to perform %s request to %s: %w", operation, url, err)
 	}
 
 	defer response.Body.Close()
 
-	data, err := io.ReadAll(response.Body)
+	counter := &countingReader{reader: response.Body, count: 0}
+	err = api.decode(operationName, timestamp, counter, result)
+	event.ResponseSize = counter.count
+
 	if err != nil {
-		return fmt.Errorf("failed to read the body of %s request to %s: %w", operation, url, err)
-	}
+		event.Outcome = OutcomeParseFailure
 
-	if err := api.parse(operationName, timestamp, data, result); err != nil {
 		return fmt.Errorf("failed to parse response from %s: %w", operationName, err)
 	}
 
+	event.Outcome = OutcomeSuccess
+
+	if holder, ok := result.(responseHolder); ok {
+		status := holder.response()
+		event.ErrorNumber = status.ErrorNumber
+
+		if err := isError(status.ErrorNumber, status.Message); err != nil {
+			event.Outcome = OutcomeErrorResponse
+
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (api *Config) parse(operationName string, timestamp int64, data []byte, result interface{}) error {
+func (api *Config) client() *http.Client {
+	if api.Client == nil {
+		return http.DefaultClient
+	}
+
+	return api.Client
+}
+
+func (api *Config) decode(operationName string, timestamp int64, body io.Reader, result interface{}) error {
 	if api.Debug {
-		err := util.ToFile(fmt.Sprintf("debug-%s-%d.json", operationName, timestamp), data)
+		file, err := os.Create(fmt.Sprintf("debug-%s-%d.json", operationName, timestamp))
 		if err != nil {
+			// Output the error, but continue without the capture.
 			fmt.Fprintf(os.Stderr, "error writing json: %v\n", err)
+		} else {
+			defer file.Close()
+
+			body = io.TeeReader(body, file)
 		}
 	}
 
-	if err := json.Unmarshal(data, result); err != nil {
+	decoder := json.NewDecoder(body)
+
+	if stream, ok := result.(streamDecoder); ok {
+		if err := stream.decodeStream(decoder); err != nil {
+			return fmt.Errorf("failed to unmarshal response from %s: %w", operationName, err)
+		}
+	} else if err := decoder.Decode(result); err != nil {
 		return fmt.Errorf("failed to unmarshal response from %s: %w", operationName, err)
 	}
 
-	if api.Debug {
-		if err := util.ToFile(fmt.Sprintf("debug-%s-%d-marshalled.json", operationName, timestamp), data); err != nil {
-			// Output the error, but continue with the result.
-			fmt.Fprintf(os.Stderr, "error writing json: %v\n", err)
+	// Drain anything after the JSON value, so the debug capture is complete and the connection can be reused.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return fmt.Errorf("failed to read the remainder of the response from %s: %w", operationName, err)
+	}
+
+	return nil
+}
+
+var errUnexpectedToken = errors.New("unexpected token")
+
+func expectDelimiter(decoder *json.Decoder, delimiter json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read token: %w", err)
+	}
+
+	if token != delimiter {
+		return fmt.Errorf("%w: expected '%v', found '%v'", errUnexpectedToken, delimiter, token)
+	}
+
+	return nil
+}
+
+// decodeObject reads a JSON object one member at a time, leaving the decoding of each value to the field function.
+func decodeObject(decoder *json.Decoder, field func(key string) error) error {
+	if err := expectDelimiter(decoder, '{'); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("%w: expected key, found '%v'", errUnexpectedToken, token)
 		}
+
+		if err := field(key); err != nil {
+			return fmt.Errorf("failed to decode '%s': %w", key, err)
+		}
+	}
+
+	return expectDelimiter(decoder, '}')
+}
+
+// decodeArray reads a JSON array one element at a time, so only a single element is buffered by the decoder.
+func decodeArray(decoder *json.Decoder, element func() error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read token: %w", err)
+	} else if token == nil {
+		return nil
+	} else if token != json.Delim('[') {
+		return fmt.Errorf("%w: expected '[', found '%v'", errUnexpectedToken, token)
+	}
+
+	for decoder.More() {
+		if err := element(); err != nil {
+			return err
+		}
+	}
+
+	return expectDelimiter(decoder, ']')
+}
+
+func skipValue(decoder *json.Decoder) error {
+	var value json.RawMessage
+
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("failed to skip value: %w", err)
 	}
 
 	return nil
@@ -16,8 +16,8 @@ const (
 )
 
 type DeviceListResponse struct {
-	ErrorNumber int `json:"errno"`
-	Result      struct {
+	Response
+	Result struct {
 		CurrentPage int      `json:"currentPage"`
 		PageSize    int      `json:"pageSize"`
 		Total       int      `json:"total"`
@@ -51,8 +51,6 @@ func (api *Config) GetDeviceList() ([]Device, error) {
 
 		if err := api.NewRequest("POST", "/op/v0/device/list", request, response); err != nil {
 			return nil, err
-		} else if err = isError(response.ErrorNumber, ""); err != nil {
-			return nil, err
 		}
 
 		devices = append(devices, response.Result.Devices...)
@@ -1,6 +1,7 @@
 package foxess
 
 import (
+	"encoding/json"
 	"sort"
 	"time"
 )
@@ -18,9 +19,8 @@ type InverterHistory struct {
 }
 
 type HistoryResponse struct {
-	ErrorNumber int               `json:"errno"`
-	Message     string            `json:"msg"`
-	Result      []InverterHistory `json:"result"`
+	Response
+	Result []InverterHistory `json:"result"`
 }
 
 type DataPoint struct {
@@ -35,6 +35,52 @@ type VariableHistory struct {
 	Variable   string      `json:"variable"`
 }
 
+func (r *HistoryResponse) decodeStream(decoder *json.Decoder) error {
+	return decodeObject(decoder, func(key string) error {
+		switch key {
+		case "errno":
+			return decoder.Decode(&r.ErrorNumber)
+		case "msg":
+			return decoder.Decode(&r.Message)
+		case "result":
+			return decodeArray(decoder, func() error {
+				var inverter InverterHistory
+				if err := inverter.decodeStream(decoder); err != nil {
+					return err
+				}
+
+				r.Result = append(r.Result, inverter)
+
+				return nil
+			})
+		default:
+			return skipValue(decoder)
+		}
+	})
+}
+
+func (h *InverterHistory) decodeStream(decoder *json.Decoder) error {
+	return decodeObject(decoder, func(key string) error {
+		switch key {
+		case "deviceSN":
+			return decoder.Decode(&h.DeviceSN)
+		case "datas":
+			return decodeArray(decoder, func() error {
+				var variable VariableHistory
+				if err := decoder.Decode(&variable); err != nil {
+					return err
+				}
+
+				h.Variables = append(h.Variables, variable)
+
+				return nil
+			})
+		default:
+			return skipValue(decoder)
+		}
+	})
+}
+
 func (api *Config) GetVariableHistory(inverter string, begin, end time.Time, variables []string) ([]InverterHistory, error) {
 	request := &HistoryRequest{
 		Begin:        begin.UnixMilli(),
@@ -44,11 +90,7 @@ func (api *Config) GetVariableHistory(inverter string, begin, end time.Time, var
 	}
 
 	response := &HistoryResponse{} //nolint:exhaustruct
-	err := api.NewRequest("POST", "/op/v0/device/history/query", request, response)
-
-	if err != nil {
-		return nil, err
-	} else if err = isError(response.ErrorNumber, response.Message); err != nil {
+	if err := api.NewRequest("POST", "/op/v0/device/history/query", request, response); err != nil {
 		return nil, err
 	}
 
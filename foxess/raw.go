@@ -0,0 +1,24 @@
+package foxess
+
+import (
+	"encoding/json"
+)
+
+type RawResponse struct {
+	Response
+	Result json.RawMessage `json:"result"`
+}
+
+func (api *Config) RawRequest(operation, path string, body json.RawMessage) (json.RawMessage, error) {
+	var params interface{}
+	if len(body) > 0 {
+		params = body
+	}
+
+	response := &RawResponse{} //nolint:exhaustruct
+	if err := api.NewRequest(operation, path, params, response); err != nil {
+		return nil, err
+	}
+
+	return response.Result, nil
+}
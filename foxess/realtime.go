@@ -1,28 +1,292 @@
 package foxess
 
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// RealTimeBatchSize is the maximum number of serial numbers the API accepts in a single real-time query.
+const RealTimeBatchSize = 50
+
+const (
+	APIVersionAuto = "auto"
+	APIVersionV0   = "v0"
+	APIVersionV1   = "v1"
+)
+
+var ErrUnsupportedAPIVersion = errors.New("unsupported API version")
+
 type RealTimeRequest struct {
 	SerialNumbers []string `json:"sns"`
 	Variables     []string `json:"variables"`
 }
 
+type RealTimeSingleRequest struct {
+	SerialNumber string   `json:"sn"`
+	Variables    []string `json:"variables"`
+}
+
 type RealTimeResponse struct {
-	ErrorNumber int            `json:"errno"`
-	Message     string         `json:"msg"`
-	Result      []RealTimeData `json:"result"`
+	Response
+	Result []RealTimeData `json:"result"`
 }
 
 type RealTimeData struct {
-	Variables []struct {
-		Variable string      `json:"variable"`
-		Unit     string      `json:"unit"`
-		Name     string      `json:"name"`
-		Value    NumberAsNil `json:"value"`
-	} `json:"datas"`
-	DeviceSN string     `json:"deviceSN"`
-	Time     CustomTime `json:"time"`
+	Variables []RealTimeVariable `json:"datas"`
+	DeviceSN  string             `json:"deviceSN"`
+	Time      CustomTime         `json:"time"`
+}
+
+type RealTimeVariable struct {
+	Variable string      `json:"variable"`
+	Unit     string      `json:"unit"`
+	Name     string      `json:"name"`
+	Value    NumberAsNil `json:"value"`
+}
+
+// BatchError reports the serial numbers of a real-time query that failed.
+type BatchError struct {
+	SerialNumbers []string
+	Err           error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("failed to retrieve real-time data for %s: %v", strings.Join(e.SerialNumbers, ","), e.Err)
 }
 
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// GetRealTimeData queries the inverters in batches, returning the data of every successful batch alongside a
+// joined error of *BatchError for those that failed.
 func (api *Config) GetRealTimeData(inverters, variables []string) ([]RealTimeData, error) {
+	switch api.APIVersion {
+	case APIVersionV0:
+		return api.getRealTimeV0(inverters, variables)
+	case APIVersionV1:
+		return api.getRealTimeV1(inverters, variables, api.isolate)
+	case "", APIVersionAuto:
+		var v1, v0 []string
+
+		for _, inverter := range inverters {
+			if _, ok := api.legacyDevices.Load(inverter); ok {
+				v0 = append(v0, inverter)
+			} else {
+				v1 = append(v1, inverter)
+			}
+		}
+
+		result, err := api.getRealTimeV1(v1, variables, api.fallback)
+		legacy, legacyErr := api.getRealTimeV0(v0, variables)
+
+		return append(result, legacy...), errors.Join(err, legacyErr)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAPIVersion, api.APIVersion)
+	}
+}
+
+func (api *Config) getRealTimeV1(inverters, variables []string, onFailure func(inverters, variables []string, err error) ([]RealTimeData, error)) ([]RealTimeData, error) {
+	var (
+		result []RealTimeData
+		errs   []error
+	)
+
+	for batch := range slices.Chunk(inverters, RealTimeBatchSize) {
+		data, err := api.getRealTimeBatch(batch, variables)
+		if err != nil {
+			data, err = onFailure(batch, variables, err)
+		} else if api.APIVersion != APIVersionV1 {
+			data, err = api.fillMissing(batch, variables, data)
+		}
+
+		result = append(result, data...)
+		errs = append(errs, err)
+	}
+
+	return result, errors.Join(errs...)
+}
+
+func (api *Config) getRealTimeV0(inverters, variables []string) ([]RealTimeData, error) {
+	var (
+		result []RealTimeData
+		errs   []error
+	)
+
+	for _, inverter := range inverters {
+		data, err := api.getRealTimeSingle(inverter, variables)
+		if err != nil {
+			errs = append(errs, &BatchError{SerialNumbers: []string{inverter}, Err: err})
+
+			continue
+		}
+
+		result = append(result, data...)
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// unsupportedOnV1 are the errnos with which the v1 endpoint rejects a device it does not serve, but the v0 endpoint
+// may. Errors of the account, such as rate limits, are deliberately absent, as v0 would fail the same way.
+var unsupportedOnV1 = []int{41930, 44096}
+
+// fallback isolates the devices of a batch rejected by the v1 endpoint, then retries those singled out as unsupported
+// by v1 against the v0 endpoint, remembering those that succeed so future queries go straight to v0.
+func (api *Config) fallback(inverters, variables []string, err error) ([]RealTimeData, error) {
+	result, err := api.isolate(inverters, variables, err)
+
+	var (
+		unsupported []string
+		errs        []error
+	)
+
+	for _, batchError := range batchErrors(err) {
+		if len(batchError.SerialNumbers) == 1 && isUnsupportedOnV1(batchError.Err) {
+			unsupported = append(unsupported, batchError.SerialNumbers[0])
+		} else {
+			errs = append(errs, batchError)
+		}
+	}
+
+	legacy, err := api.fallbackToV0(unsupported, variables)
+
+	return append(result, legacy...), errors.Join(append(errs, err)...)
+}
+
+func isUnsupportedOnV1(err error) bool {
+	var responseError *ResponseError
+
+	return errors.As(err, &responseError) && slices.Contains(unsupportedOnV1, responseError.ErrorNumber)
+}
+
+func (api *Config) fallbackToV0(inverters, variables []string) ([]RealTimeData, error) {
+	result, err := api.getRealTimeV0(inverters, variables)
+	for _, data := range result {
+		api.legacyDevices.Store(data.DeviceSN, true)
+	}
+
+	return result, err
+}
+
+// fillMissing falls back to v0 for any inverters the v1 endpoint silently left out of its result.
+func (api *Config) fillMissing(inverters, variables []string, data []RealTimeData) ([]RealTimeData, error) {
+	var missing []string
+
+	for _, inverter := range inverters {
+		if !slices.ContainsFunc(data, func(d RealTimeData) bool { return d.DeviceSN == inverter }) {
+			missing = append(missing, inverter)
+		}
+	}
+
+	if len(missing) == 0 {
+		return data, nil
+	}
+
+	legacy, err := api.fallbackToV0(missing, variables)
+
+	return append(data, legacy...), err
+}
+
+// isolate splits a batch rejected by FoxESS in two, so a single problematic serial number cannot fail the others.
+// Splitting stops once both halves are rejected, as the problem then lies beyond an individual device, unless both
+// were rejected as unsupported by v1, which every device of the batch may be.
+func (api *Config) isolate(inverters, variables []string, err error) ([]RealTimeData, error) {
+	var responseError *ResponseError
+	if len(inverters) == 1 || !errors.As(err, &responseError) {
+		return nil, &BatchError{SerialNumbers: inverters, Err: err}
+	}
+
+	half := len(inverters) / 2
+	halves := [2][]string{inverters[:half], inverters[half:]}
+
+	var (
+		results [2][]RealTimeData
+		errs    [2]error
+	)
+
+	for i, batch := range halves {
+		results[i], errs[i] = api.getRealTimeBatch(batch, variables)
+	}
+
+	if errs[0] != nil && errs[1] != nil && (!isUnsupportedOnV1(errs[0]) || !isUnsupportedOnV1(errs[1])) {
+		return nil, errors.Join(&BatchError{SerialNumbers: halves[0], Err: errs[0]}, &BatchError{SerialNumbers: halves[1], Err: errs[1]})
+	}
+
+	var result []RealTimeData
+
+	for i, batch := range halves {
+		if errs[i] != nil {
+			results[i], errs[i] = api.isolate(batch, variables, errs[i])
+		}
+
+		result = append(result, results[i]...)
+	}
+
+	return result, errors.Join(errs[:]...)
+}
+
+// FailedSerialNumbers maps each serial number reported by a *BatchError within err to the cause of its failure.
+func FailedSerialNumbers(err error) map[string]error {
+	failures := make(map[string]error)
+
+	for _, batchError := range batchErrors(err) {
+		for _, serialNumber := range batchError.SerialNumbers {
+			failures[serialNumber] = batchError.Err
+		}
+	}
+
+	return failures
+}
+
+// batchErrors flattens the *BatchError within err, however deeply they are joined.
+func batchErrors(err error) []*BatchError {
+	var (
+		batchError *BatchError
+		joined     interface{ Unwrap() []error }
+	)
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &joined):
+		var result []*BatchError
+		for _, inner := range joined.Unwrap() {
+			result = append(result, batchErrors(inner)...)
+		}
+
+		return result
+	case errors.As(err, &batchError):
+		return []*BatchError{batchError}
+	default:
+		return nil
+	}
+}
+
+func (api *Config) getRealTimeSingle(inverter string, variables []string) ([]RealTimeData, error) {
+	request := &RealTimeSingleRequest{
+		SerialNumber: inverter,
+		Variables:    variables,
+	}
+
+	response := &RealTimeResponse{} //nolint:exhaustruct
+	if err := api.NewRequest("POST", "/op/v0/device/real/query", request, response); err != nil {
+		return nil, err
+	}
+
+	// The v0 endpoint does not always identify the device, so normalise it to match v1.
+	for i := range response.Result {
+		if response.Result[i].DeviceSN == "" {
+			response.Result[i].DeviceSN = inverter
+		}
+	}
+
+	return response.Result, nil
+}
+
+func (api *Config) getRealTimeBatch(inverters, variables []string) ([]RealTimeData, error) {
 	request := &RealTimeRequest{
 		SerialNumbers: inverters,
 		Variables:     variables,
@@ -31,8 +295,6 @@ func (api *Config) GetRealTimeData(inverters, variables []string) ([]RealTimeDat
 	response := &RealTimeResponse{} //nolint:exhaustruct
 	if err := api.NewRequest("POST", "/op/v1/device/real/query", request, response); err != nil {
 		return nil, err
-	} else if err = isError(response.ErrorNumber, response.Message); err != nil {
-		return nil, err
 	}
 
 	return response.Result, nil
@@ -4,9 +4,8 @@ import "maps"
 
 // Define the structure for the response.
 type VariablesResponse struct {
-	ErrorNumber int                   `json:"errno"`
-	Message     string                `json:"msg"`
-	Result      []map[string]Variable `json:"result"`
+	Response
+	Result []map[string]Variable `json:"result"`
 }
 
 type Variable struct {
@@ -20,8 +19,6 @@ func (api *Config) GetVariables(gridOnly bool) (*[]map[string]Variable, error) {
 
 	if err := api.NewRequest("GET", "/op/v0/device/variable/get", nil, response); err != nil {
 		return nil, err
-	} else if err = isError(response.ErrorNumber, response.Message); err != nil {
-		return nil, err
 	} else if !gridOnly {
 		return &response.Result, nil
 	}
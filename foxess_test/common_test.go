@@ -1,9 +1,11 @@
 package foxess_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/teh-hippo/foxess-exporter/foxess"
 )
 
@@ -15,3 +17,22 @@ func TestCalculateSignature(t *testing.T) {
 
 	assert.Equal(t, want, got)
 }
+
+func TestNumberAsNilAcceptsOnlyJSONNumbers(t *testing.T) {
+	t.Parallel()
+
+	for input, expected := range map[string]float64{
+		`1.5`: 1.5, `"1.5"`: 1.5, `-0.25e2`: -25, `0`: 0, `""`: 0, `null`: 0, `"null"`: 0,
+	} {
+		var number foxess.NumberAsNil
+
+		require.NoError(t, json.Unmarshal([]byte(input), &number), input)
+		assert.InDelta(t, expected, number.Number, 0, input)
+	}
+
+	for _, input := range []string{`"NaN"`, `"Inf"`, `"-Infinity"`, `"0x1p-2"`, `"01"`, `"1."`, `".5"`, `"1e"`, `"+1"`, `"1_000"`} {
+		var number foxess.NumberAsNil
+
+		assert.Error(t, json.Unmarshal([]byte(input), &number), input)
+	}
+}
@@ -0,0 +1,134 @@
+package foxess_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+type historyFixture struct {
+	name      string
+	inverters int
+	variables int
+	points    int
+}
+
+var historyFixtures = []historyFixture{
+	{name: "small", inverters: 1, variables: 2, points: 288},
+	{name: "large", inverters: 10, variables: 20, points: 1440},
+}
+
+func buildHistoryFixture(b *testing.B, fixture historyFixture) []byte {
+	b.Helper()
+
+	begin := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	result := make([]map[string]any, fixture.inverters)
+
+	for i := range result {
+		datas := make([]map[string]any, fixture.variables)
+
+		for v := range datas {
+			points := make([]map[string]any, fixture.points)
+			for p := range points {
+				points[p] = map[string]any{
+					"time":  begin.Add(time.Duration(p) * time.Minute).Format("2006-01-02 15:04:05 MST-0700"),
+					"value": float64(p) / 10,
+				}
+			}
+
+			datas[v] = map[string]any{
+				"unit":     "kW",
+				"name":     fmt.Sprintf("Variable %d", v),
+				"variable": fmt.Sprintf("variable%d", v),
+				"data":     points,
+			}
+		}
+
+		result[i] = map[string]any{
+			"deviceSN": fmt.Sprintf("SN%04d", i),
+			"datas":    datas,
+		}
+	}
+
+	data, err := json.Marshal(map[string]any{"errno": 0, "msg": "success", "result": result})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return data
+}
+
+func historyServer(b *testing.B, data []byte) *httptest.Server {
+	b.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+	b.Cleanup(server.Close)
+
+	return server
+}
+
+func BenchmarkGetVariableHistory(b *testing.B) {
+	for _, fixture := range historyFixtures {
+		b.Run(fixture.name, func(b *testing.B) {
+			data := buildHistoryFixture(b, fixture)
+			server := historyServer(b, data)
+			config := &foxess.Config{APIKey: "key", Debug: false, Client: redirect(server)}
+			begin := time.Now().Add(-time.Hour)
+			end := time.Now()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+
+			for range b.N {
+				if _, err := config.GetVariableHistory("SN0000", begin, end, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBufferedHistory measures the previous approach of reading the whole body before unmarshalling, for comparison.
+// Streaming roughly halves the bytes allocated for the large fixture, but not the number of allocations, which is
+// dominated by the data points themselves.
+func BenchmarkBufferedHistory(b *testing.B) {
+	for _, fixture := range historyFixtures {
+		b.Run(fixture.name, func(b *testing.B) {
+			data := buildHistoryFixture(b, fixture)
+			server := historyServer(b, data)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+
+			for range b.N {
+				response, err := http.Post(server.URL, "application/json", nil) //nolint:noctx
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				body, err := io.ReadAll(response.Body)
+				response.Body.Close()
+
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				result := &foxess.HistoryResponse{} //nolint:exhaustruct
+				if err := json.Unmarshal(body, result); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
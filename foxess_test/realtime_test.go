@@ -0,0 +1,291 @@
+package foxess_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+func serialNumbers(count int) []string {
+	result := make([]string, count)
+	for i := range result {
+		result[i] = fmt.Sprintf("SN%03d", i)
+	}
+
+	return result
+}
+
+func realTimeResult(serialNumbers []string) string {
+	items := make([]string, len(serialNumbers))
+	for i, sn := range serialNumbers {
+		items[i] = fmt.Sprintf(`{"deviceSN":"%s","time":"2024-01-01 00:00:00 CST+0800","datas":[{"variable":"pvPower","unit":"kW","value":1.5}]}`, sn)
+	}
+
+	return `{"errno":0,"msg":"success","result":[` + strings.Join(items, ",") + `]}`
+}
+
+func TestRealTimeIsBatched(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mutex   sync.Mutex
+		batches []int
+	)
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		request := &foxess.RealTimeRequest{} //nolint:exhaustruct
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(request))
+
+		mutex.Lock()
+		batches = append(batches, len(request.SerialNumbers))
+		mutex.Unlock()
+
+		_, _ = w.Write([]byte(realTimeResult(request.SerialNumbers)))
+	})
+
+	inverters := serialNumbers(2*foxess.RealTimeBatchSize + 1)
+
+	data, err := config.GetRealTimeData(inverters, []string{"pvPower"})
+	require.NoError(t, err)
+	assert.Equal(t, []int{foxess.RealTimeBatchSize, foxess.RealTimeBatchSize, 1}, batches)
+	require.Len(t, data, len(inverters))
+	assert.Equal(t, inverters[len(inverters)-1], data[len(data)-1].DeviceSN)
+}
+
+func TestRealTimeKeepsSuccessfulBatches(t *testing.T) {
+	t.Parallel()
+
+	inverters := serialNumbers(foxess.RealTimeBatchSize + 2)
+	failed := inverters[foxess.RealTimeBatchSize:]
+
+	config := newTestConfig(t, rejectingServer(t, failed...))
+	config.APIVersion = foxess.APIVersionV1
+
+	data, err := config.GetRealTimeData(inverters, nil)
+	require.ErrorIs(t, err, foxess.ErrFoxessErrorResponse)
+	assert.Len(t, data, foxess.RealTimeBatchSize)
+
+	failures := foxess.FailedSerialNumbers(err)
+	assert.Len(t, failures, len(failed))
+
+	for _, serialNumber := range failed {
+		var responseError *foxess.ResponseError
+		require.ErrorAs(t, failures[serialNumber], &responseError)
+		assert.Equal(t, 41930, responseError.ErrorNumber)
+	}
+}
+
+func TestRealTimeIsolatesRejectedDevice(t *testing.T) {
+	t.Parallel()
+
+	inverters := serialNumbers(foxess.RealTimeBatchSize)
+	rejected := inverters[17]
+
+	config := newTestConfig(t, rejectingServer(t, rejected))
+	config.APIVersion = foxess.APIVersionV1
+
+	data, err := config.GetRealTimeData(inverters, nil)
+	require.Error(t, err)
+	assert.Len(t, data, len(inverters)-1)
+	assert.Equal(t, []string{rejected}, slices.Collect(maps.Keys(foxess.FailedSerialNumbers(err))))
+}
+
+func TestRealTimeStopsIsolatingAccountErrors(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+
+	config := newTestConfig(t, func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte(`{"errno":40400,"msg":"request too frequent"}`))
+	})
+	config.APIVersion = foxess.APIVersionV1
+
+	data, err := config.GetRealTimeData(serialNumbers(foxess.RealTimeBatchSize), nil)
+	require.ErrorIs(t, err, foxess.ErrFoxessErrorResponse)
+	assert.Empty(t, data)
+	assert.Len(t, foxess.FailedSerialNumbers(err), foxess.RealTimeBatchSize)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+// rejectingServer responds with an error to any real-time query that includes one of the rejected serial numbers.
+func rejectingServer(t *testing.T, rejected ...string) http.HandlerFunc {
+	t.Helper()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := &foxess.RealTimeRequest{} //nolint:exhaustruct
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(request))
+
+		for _, serialNumber := range rejected {
+			if slices.Contains(request.SerialNumbers, serialNumber) {
+				_, _ = w.Write([]byte(`{"errno":41930,"msg":"device not found"}`))
+
+				return
+			}
+		}
+
+		_, _ = w.Write([]byte(realTimeResult(request.SerialNumbers)))
+	}
+}
+
+func TestRealTimeFallsBackToV0(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mutex sync.Mutex
+		paths []string
+	)
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths = append(paths, r.URL.Path)
+		mutex.Unlock()
+
+		switch r.URL.Path {
+		case "/op/v1/device/real/query":
+			_, _ = w.Write([]byte(realTimeResult([]string{"new"})))
+		case "/op/v0/device/real/query":
+			request := &foxess.RealTimeSingleRequest{} //nolint:exhaustruct
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(request))
+			assert.Equal(t, "old", request.SerialNumber)
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"time":"2024-01-01 00:00:00 CST+0800","datas":[{"variable":"pvPower","unit":"kW","value":2}]}]}`))
+		}
+	})
+
+	data, err := config.GetRealTimeData([]string{"new", "old"}, []string{"pvPower"})
+	require.NoError(t, err)
+	require.Len(t, data, 2)
+	assert.Equal(t, "new", data[0].DeviceSN)
+	assert.Equal(t, "old", data[1].DeviceSN)
+	assert.InDelta(t, 2.0, data[1].Variables[0].Value.Number, 0)
+
+	// Devices that needed v0 are queried there directly from then on.
+	_, err = config.GetRealTimeData([]string{"new", "old"}, []string{"pvPower"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"/op/v1/device/real/query", "/op/v0/device/real/query",
+		"/op/v1/device/real/query", "/op/v0/device/real/query",
+	}, paths)
+}
+
+func TestRealTimeFallsBackOnlyForIsolatedDevices(t *testing.T) {
+	t.Parallel()
+
+	inverters := serialNumbers(foxess.RealTimeBatchSize)
+	rejected := inverters[17]
+
+	var v1, v0 atomic.Int32
+
+	reject := rejectingServer(t, rejected)
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/op/v0/device/real/query" {
+			v0.Add(1)
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"time":"2024-01-01 00:00:00 CST+0800","datas":[]}]}`))
+
+			return
+		}
+
+		v1.Add(1)
+		reject(w, r)
+	})
+
+	data, err := config.GetRealTimeData(inverters, nil)
+	require.NoError(t, err)
+	assert.Len(t, data, len(inverters))
+	assert.Equal(t, int32(1), v0.Load(), "only the rejected device falls back")
+	assert.LessOrEqual(t, v1.Load(), int32(1+2*6), "the batch is bisected rather than queried device by device")
+
+	// Afterwards, the rest stay batched on v1 and only the rejected device is queried on v0.
+	v1.Store(0)
+	v0.Store(0)
+
+	data, err = config.GetRealTimeData(inverters, nil)
+	require.NoError(t, err)
+	assert.Len(t, data, len(inverters))
+	assert.Equal(t, int32(1), v1.Load())
+	assert.Equal(t, int32(1), v0.Load())
+}
+
+func TestRealTimeFallsBackWhenEveryDeviceIsLegacy(t *testing.T) {
+	t.Parallel()
+
+	inverters := serialNumbers(4)
+
+	var v1, v0 atomic.Int32
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/op/v0/device/real/query" {
+			v0.Add(1)
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"time":"2024-01-01 00:00:00 CST+0800","datas":[]}]}`))
+
+			return
+		}
+
+		v1.Add(1)
+		_, _ = w.Write([]byte(`{"errno":41930,"msg":"device not found"}`))
+	})
+
+	data, err := config.GetRealTimeData(inverters, nil)
+	require.NoError(t, err)
+	assert.Len(t, data, len(inverters))
+	assert.Equal(t, int32(1+2+4), v1.Load(), "the batch is bisected down to each device")
+	assert.Equal(t, int32(len(inverters)), v0.Load())
+
+	v1.Store(0)
+	v0.Store(0)
+
+	data, err = config.GetRealTimeData(inverters, nil)
+	require.NoError(t, err)
+	assert.Len(t, data, len(inverters))
+	assert.Equal(t, int32(0), v1.Load())
+	assert.Equal(t, int32(len(inverters)), v0.Load())
+}
+
+func TestRealTimeDoesNotFallBackOnAccountErrors(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/op/v1/device/real/query", r.URL.Path)
+		requests.Add(1)
+		_, _ = w.Write([]byte(`{"errno":40400,"msg":"request too frequent"}`))
+	})
+
+	_, err := config.GetRealTimeData(serialNumbers(foxess.RealTimeBatchSize), nil)
+	require.ErrorIs(t, err, foxess.ErrFoxessErrorResponse)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestRealTimeV0Only(t *testing.T) {
+	t.Parallel()
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/op/v0/device/real/query", r.URL.Path)
+		_, _ = w.Write([]byte(`{"errno":0,"result":[{"time":"2024-01-01 00:00:00 CST+0800","datas":[]}]}`))
+	})
+	config.APIVersion = foxess.APIVersionV0
+
+	data, err := config.GetRealTimeData([]string{"1", "2"}, nil)
+	require.NoError(t, err)
+	assert.Len(t, data, 2)
+}
+
+func TestRealTimeUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+
+	config := &foxess.Config{APIKey: "key", APIVersion: "v9"} //nolint:exhaustruct
+
+	_, err := config.GetRealTimeData([]string{"1"}, nil)
+	require.ErrorIs(t, err, foxess.ErrUnsupportedAPIVersion)
+}
@@ -0,0 +1,140 @@
+package foxess_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+func newTestConfig(t *testing.T, handler http.HandlerFunc) *foxess.Config {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return &foxess.Config{APIKey: "key", Debug: false, Client: redirect(server)}
+}
+
+// redirect sends every request to the server rather than FoxESS.
+func redirect(server *httptest.Server) *http.Client {
+	return &http.Client{Transport: &redirectTransport{server: server}} //nolint:exhaustruct
+}
+
+type redirectTransport struct {
+	server *httptest.Server
+}
+
+func (x *redirectTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.URL.Scheme, request.URL.Host = "http", x.server.Listener.Addr().String()
+
+	return x.server.Client().Transport.RoundTrip(request) //nolint:wrapcheck
+}
+
+func TestRequestIsSigned(t *testing.T) {
+	t.Parallel()
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/op/v0/user/getAccessCount", r.URL.Path)
+		assert.Equal(t, "key", r.Header.Get("Token"))
+		assert.NotEmpty(t, r.Header.Get("Signature"))
+		assert.NotEmpty(t, r.Header.Get("Timestamp"))
+		_, _ = w.Write([]byte(`{"errno":0,"result":{"total":"1440","remaining":"1080"}}`))
+	})
+
+	usage, err := config.GetAPIUsage()
+	require.NoError(t, err)
+	assert.InDelta(t, 1440.0, usage.Total, 0)
+	assert.InDelta(t, 1080.0, usage.Remaining, 0)
+	assert.InDelta(t, 25.0, usage.PercentageUsed, 0.001)
+}
+
+func TestRequestReportsErrorNumber(t *testing.T) {
+	t.Parallel()
+
+	config := newTestConfig(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"errno":40256,"msg":"illegal request"}`))
+	})
+
+	_, err := config.GetDeviceList()
+	require.ErrorIs(t, err, foxess.ErrFoxessErrorResponse)
+	assert.Contains(t, err.Error(), "40256")
+	assert.Contains(t, err.Error(), "illegal request")
+}
+
+func TestRawRequestReturnsResult(t *testing.T) {
+	t.Parallel()
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		_, _ = w.Write([]byte(`{"errno":0,"result":{"value":1}}`))
+	})
+
+	result, err := config.RawRequest(http.MethodPost, "/op/v0/anything", []byte(`{"sn":"1"}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"value":1}`, string(result))
+}
+
+func TestHistoryIsStreamed(t *testing.T) {
+	t.Parallel()
+
+	config := newTestConfig(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"errno":0,"msg":"success","extra":{"ignored":[1,2]},"result":[{"deviceSN":"SN1","datas":[` +
+			`{"unit":"kW","name":"PV Power","variable":"pvPower","data":[` +
+			`{"time":"2024-01-01 00:05:00 CST+0800","value":"2.5"},{"time":"2024-01-01 00:00:00 CST+0800","value":1.5}]},` +
+			`{"unit":"%","name":"SoC","variable":"SoC","data":[{"time":"2024-01-01 00:00:00 CST+0800","value":null}]}]}]}`))
+	})
+
+	history, err := config.GetVariableHistory("SN1", time.Now().Add(-time.Hour), time.Now(), []string{"pvPower", "SoC"})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "SN1", history[0].DeviceSN)
+	require.Len(t, history[0].Variables, 2)
+
+	pvPower := history[0].Variables[0]
+	assert.Equal(t, "pvPower", pvPower.Variable)
+	require.Len(t, pvPower.DataPoints, 2)
+	assert.InDelta(t, 1.5, pvPower.DataPoints[0].Value.Number, 0)
+	assert.InDelta(t, 2.5, pvPower.DataPoints[1].Value.Number, 0)
+	assert.InDelta(t, 0.0, history[0].Variables[1].DataPoints[0].Value.Number, 0)
+}
+
+func TestRequestHookObservesOutcome(t *testing.T) {
+	t.Parallel()
+
+	responses := map[string]string{
+		"/success": `{"errno":0,"result":{}}`,
+		"/error":   `{"errno":40257,"msg":"invalid param"}`,
+		"/garbage": `<html>`,
+	}
+
+	config := newTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(responses[r.URL.Path]))
+	})
+
+	events := make(map[string]foxess.RequestEvent)
+	config.AddRequestHook(func(event *foxess.RequestEvent) {
+		events[event.Path] = *event
+	})
+
+	for path := range responses {
+		_, _ = config.RawRequest(http.MethodGet, path, nil)
+	}
+
+	assert.Equal(t, foxess.OutcomeSuccess, events["/success"].Outcome)
+	assert.Equal(t, int64(len(responses["/success"])), events["/success"].ResponseSize)
+	assert.Positive(t, events["/success"].Duration)
+	require.NoError(t, events["/success"].Err)
+
+	assert.Equal(t, foxess.OutcomeErrorResponse, events["/error"].Outcome)
+	assert.Equal(t, 40257, events["/error"].ErrorNumber)
+	require.ErrorIs(t, events["/error"].Err, foxess.ErrFoxessErrorResponse)
+
+	assert.Equal(t, foxess.OutcomeParseFailure, events["/garbage"].Outcome)
+	assert.Equal(t, http.MethodGet, events["/garbage"].Method)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+type HealthCheckCommand struct {
+	Port    int           `short:"p" long:"port"    description:"Port the exporter is listening on"             env:"PORT"   default:"2112"`
+	Ready   bool          `short:"r" long:"ready"   description:"Check readiness (/readyz) instead of /healthz"`
+	Timeout time.Duration `short:"t" long:"timeout" description:"Time allowed for the check"                    default:"5s"`
+}
+
+func (x *HealthCheckCommand) Register(parser *flags.Parser, _ *foxess.Config) {
+	const description = "Query the health endpoint of a running exporter, exiting non-zero when unhealthy. Suitable for Docker HEALTHCHECK."
+	if _, err := parser.AddCommand("healthcheck", "Check a running exporter", description, x); err != nil {
+		panic(err)
+	}
+}
+
+// RequiresAPIKey is false, as the health check queries the running exporter rather than FoxESS.
+func (x *HealthCheckCommand) RequiresAPIKey() bool {
+	return false
+}
+
+func (x *HealthCheckCommand) Execute(_ []string) error {
+	return x.check(fmt.Sprintf("http://127.0.0.1:%d", x.Port))
+}
+
+func (x *HealthCheckCommand) check(baseURL string) error {
+	path := "/healthz"
+	if x.Ready {
+		path = "/readyz"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), x.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %w", path, err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %d: %s", ErrUnhealthy, path, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
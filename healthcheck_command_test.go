@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+func TestHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" {
+			http.Error(w, `{"status":"not ready"}`, http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	subject := &HealthCheckCommand{Port: 0, Ready: false, Timeout: time.Second}
+	require.NoError(t, subject.check(server.URL))
+
+	subject.Ready = true
+	err := subject.check(server.URL)
+	require.ErrorIs(t, err, ErrUnhealthy)
+	assert.Contains(t, err.Error(), "/readyz returned 503")
+}
+
+func TestHealthCheckDoesNotNeedAnAPIKey(t *testing.T) { //nolint:paralleltest
+	t.Setenv("API_KEY", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+
+	address, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	_, err = newParser(&foxess.Config{}, flags.None).ParseArgs([]string{"healthcheck", "--port", address.Port()}) //nolint:exhaustruct
+	require.NoError(t, err)
+
+	var flagsErr *flags.Error
+
+	_, err = newParser(&foxess.Config{}, flags.None).ParseArgs([]string{"api-usage"}) //nolint:exhaustruct
+	require.ErrorAs(t, err, &flagsErr)
+	assert.Equal(t, flags.ErrRequired, flagsErr.Type)
+
+	var help strings.Builder
+
+	newParser(&foxess.Config{}, flags.None).WriteHelp(&help) //nolint:exhaustruct
+	assert.Contains(t, help.String(), "FoxESS API Key, required to call FoxESS")
+}
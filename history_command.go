@@ -1,22 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/jessevdk/go-flags"
-	"github.com/prometheus/prometheus/prompb"
 	"github.com/rodaine/table"
 	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/sink"
 	"github.com/teh-hippo/foxess-exporter/util"
 )
 
@@ -41,6 +36,10 @@ func (x *HistoryCommand) Register(parser *flags.Parser, config *foxess.Config) {
 	x.config = config
 }
 
+func (x *HistoryCommand) RequiresAPIKey() bool {
+	return true
+}
+
 var ErrRemoteWrite = errors.New("failed to perform remote write operation")
 
 const OneDay = 24 * time.Hour
@@ -153,97 +152,23 @@ func createTable(inverterHistories []foxess.InverterHistory) {
 }
 
 func (x *HistoryCommand) remoteWrite(date time.Time, inverterHistories []foxess.InverterHistory) error {
-	httpClient := &http.Client{ //nolint:exhaustruct
-		Timeout: Ten * time.Second,
-	}
-
-	marshalled, err := proto.Marshal(&prompb.WriteRequest{ //nolint:exhaustruct
-		Timeseries: convertToTimeSeries(inverterHistories),
-	})
+	client, err := sink.NewRemoteWriteClient(x.RemoteWriteTarget, &sink.HTTPConfig{Timeout: Ten * time.Second}) //nolint:exhaustruct
 	if err != nil {
-		return fmt.Errorf("%w: failed to marshall variables to time series: %w", ErrRemoteWrite, err)
+		return fmt.Errorf("%w: %w", ErrRemoteWrite, err)
 	}
 
-	request, err := http.NewRequestWithContext(context.Background(), http.MethodPost, x.RemoteWriteTarget, bytes.NewBuffer(snappy.Encode(nil, marshalled)))
-	if err != nil {
-		return fmt.Errorf("%w: write request failed: %w", ErrRemoteWrite, err)
-	}
+	err = client.Send(context.Background(), sink.HistoryTimeSeries(inverterHistories, true))
 
-	request.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
-	request.Header.Add("Content-Encoding", "snappy")
-	request.Header.Set("Content-Type", "application/x-protobuf")
-	request.Header.Set("User-Agent", "foxess-exporter 1.0")
+	var httpError *sink.HTTPError
+	if errors.As(err, &httpError) && httpError.StatusCode == http.StatusBadRequest && httpError.Message == "out of bounds" {
+		log.Printf("Ignoring failed remote-write for %s: %v", date.Format(time.DateOnly), err)
 
-	// Send http request.
-	httpResp, err := httpClient.Do(request)
-	if err != nil {
-		return fmt.Errorf("%w: failed to complete request '%s': %w", ErrRemoteWrite, x.RemoteWriteTarget, err)
+		return nil
 	}
-	defer httpResp.Body.Close()
 
-	if httpResp.StatusCode < http.StatusOK || httpResp.StatusCode >= http.StatusMultipleChoices {
-		response, err := io.ReadAll(httpResp.Body)
-		if err != nil {
-			return fmt.Errorf("%w: %d response, and unable to read response: %w", ErrRemoteWrite, httpResp.StatusCode, err)
-		}
-
-		message := strings.Trim(string(response), "\n")
-		if httpResp.StatusCode == http.StatusBadRequest && message == "out of bounds" {
-			log.Printf("Ignoring failed remote-write for %s: %s - %s", date.Format(time.DateOnly), httpResp.Status, message)
-
-			return nil
-		}
-
-		return fmt.Errorf("%w: %d: %s", ErrRemoteWrite, httpResp.StatusCode, message)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRemoteWrite, err)
 	}
 
 	return nil
 }
-
-func convertToTimeSeries(inverterHistories []foxess.InverterHistory) []prompb.TimeSeries {
-	const endOfSeries = 0x7ff0000000000002
-
-	var timeSeries []prompb.TimeSeries
-
-	for _, inverter := range inverterHistories {
-		bulk := make([]prompb.TimeSeries, len(inverter.Variables))
-
-		for variableIndex, variable := range inverter.Variables {
-			samples := make([]prompb.Sample, len(variable.DataPoints)+1)
-
-			for dataIndex, dataPoint := range variable.DataPoints {
-				samples[dataIndex] = prompb.Sample{ //nolint:exhaustruct
-					Timestamp: dataPoint.Time.UnixNano() / int64(time.Millisecond),
-					Value:     dataPoint.Value.Number,
-				}
-			}
-
-			samples[len(samples)-1] = prompb.Sample{ //nolint:exhaustruct
-				Timestamp: variable.DataPoints[len(variable.DataPoints)-1].Time.UnixNano()/int64(time.Millisecond) + 1,
-				Value:     endOfSeries,
-			}
-
-			bulk[variableIndex] = prompb.TimeSeries{ //nolint:exhaustruct
-				Labels: []prompb.Label{
-					{ //nolint:exhaustruct
-						Name:  "__name__",
-						Value: "foxess_realtime_data",
-					},
-					{ //nolint:exhaustruct
-						Name:  "inverter",
-						Value: inverter.DeviceSN,
-					},
-					{ //nolint:exhaustruct
-						Name:  "variable",
-						Value: variable.Variable,
-					},
-				},
-				Samples: samples,
-			}
-		}
-
-		timeSeries = append(timeSeries, bulk...)
-	}
-
-	return timeSeries
-}
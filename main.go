@@ -17,27 +17,18 @@ const (
 var (
 	ErrUnsupportedFormat = errors.New("unsupported output format")
 	ErrInvalidArgument   = errors.New("invalid argument")
+	ErrUnhealthy         = errors.New("unhealthy")
 )
 
 type Runner interface {
 	Register(parser *flags.Parser, config *foxess.Config)
+	// RequiresAPIKey reports whether the command calls FoxESS, and so cannot run without an API key.
+	RequiresAPIKey() bool
 }
 
 func main() {
 	foxessAPI := foxess.Config{} //nolint:exhaustruct
-	parser := flags.NewParser(&foxessAPI, flags.Default)
-	commands := []Runner{
-		&APIUsageCommand{},  //nolint:exhaustruct
-		&DevicesCommand{},   //nolint:exhaustruct
-		&HistoryCommand{},   //nolint:exhaustruct
-		&RealTimeCommand{},  //nolint:exhaustruct
-		&ServeCommand{},     //nolint:exhaustruct
-		&VariablesCommand{}, //nolint:exhaustruct
-	}
-
-	for _, command := range commands {
-		command.Register(parser, &foxessAPI)
-	}
+	parser := newParser(&foxessAPI, flags.Default)
 
 	if _, err := parser.Parse(); err != nil {
 		var flagsErr *flags.Error
@@ -52,3 +43,31 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func newParser(foxessAPI *foxess.Config, options flags.Options) *flags.Parser {
+	parser := flags.NewParser(foxessAPI, options)
+	commands := []Runner{
+		&APIUsageCommand{},    //nolint:exhaustruct
+		&DevicesCommand{},     //nolint:exhaustruct
+		&HealthCheckCommand{}, //nolint:exhaustruct
+		&HistoryCommand{},     //nolint:exhaustruct
+		&RawCommand{},         //nolint:exhaustruct
+		&RealTimeCommand{},    //nolint:exhaustruct
+		&ServeCommand{},       //nolint:exhaustruct
+		&VariablesCommand{},   //nolint:exhaustruct
+	}
+
+	for _, command := range commands {
+		command.Register(parser, foxessAPI)
+	}
+
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if runner, ok := command.(Runner); ok && runner.RequiresAPIKey() && foxessAPI.APIKey == "" {
+			return &flags.Error{Type: flags.ErrRequired, Message: "the required flag `-k, --api-key' was not specified"}
+		}
+
+		return command.Execute(args)
+	}
+
+	return parser
+}
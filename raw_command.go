@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+	"github.com/teh-hippo/foxess-exporter/util"
+)
+
+type RawCommand struct {
+	Data           string `short:"D" long:"data"             description:"JSON request body, or @file to read it from a file"`
+	ShowUsage      bool   `short:"u" long:"usage"            description:"Log the API usage tracked in the state file after the request"`
+	StateFile      string `short:"f" long:"state-file"       description:"State file of serve, whose API quota the call is recorded against" env:"STATE_FILE"`
+	QuotaResetZone string `short:"z" long:"quota-reset-zone" description:"Time zone of the daily API quota reset"                          env:"QUOTA_RESET_ZONE" default:"Local"`
+	Args           struct {
+		Method string `positional-arg-name:"method" description:"HTTP method, e.g. GET or POST"`
+		Path   string `positional-arg-name:"path"   description:"OpenAPI path, e.g. /op/v0/device/list"`
+	} `positional-args:"yes" required:"yes"`
+	config *foxess.Config
+}
+
+func (x *RawCommand) Register(parser *flags.Parser, config *foxess.Config) {
+	if _, err := parser.AddCommand("raw", "Perform a raw API call", "Perform a signed call to any FoxESS OpenAPI endpoint and output the JSON result.", x); err != nil {
+		panic(err)
+	}
+
+	x.config = config
+}
+
+func (x *RawCommand) RequiresAPIKey() bool {
+	return true
+}
+
+func (x *RawCommand) Execute(_ []string) error {
+	method := strings.ToUpper(x.Args.Method)
+	if method != http.MethodGet && method != http.MethodPost {
+		return fmt.Errorf("%w: unsupported method '%s'", ErrInvalidArgument, x.Args.Method)
+	}
+
+	if !strings.HasPrefix(x.Args.Path, "/") {
+		return fmt.Errorf("%w: path must start with '/': %s", ErrInvalidArgument, x.Args.Path)
+	}
+
+	body, err := x.body()
+	if err != nil {
+		return err
+	}
+
+	if x.ShowUsage && x.StateFile == "" {
+		return fmt.Errorf("%w: usage is tracked in the state file, so --usage requires --state-file", ErrInvalidArgument)
+	}
+
+	state, quota, err := x.trackQuota()
+	if err != nil {
+		return err
+	}
+
+	result, err := x.config.RawRequest(method, x.Args.Path, body)
+
+	if state != nil {
+		state.Quota = quota.Snapshot()
+		if err := state.Save(x.StateFile); err != nil {
+			log.Printf("Unable to record the call against the API quota: %v", err)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to perform %s request to %s: %w", method, x.Args.Path, err)
+	}
+
+	if err := util.JSONToStdOut(result); err != nil {
+		return fmt.Errorf("failed to output result: %w", err)
+	}
+
+	if x.ShowUsage {
+		if usage, _ := quota.Current(); usage == nil {
+			log.Printf("Usage: unknown until serve next checks it")
+		} else {
+			log.Printf("Usage: %.0f/%.0f (%.2f%%)\n", usage.Total-usage.Remaining, usage.Total, usage.PercentageUsed)
+		}
+	}
+
+	return nil
+}
+
+// trackQuota restores the API quota serve persisted in the state file, if given, and counts each call against it, so
+// that it is saved again with the call recorded rather than spending another call to find out.
+func (x *RawCommand) trackQuota() (*serve.State, *serve.APIQuota, error) {
+	quota := serve.NewAPIQuota()
+	if x.StateFile == "" {
+		return nil, quota, nil
+	}
+
+	location, err := time.LoadLocation(x.QuotaResetZone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: unknown quota reset zone '%s': %w", ErrInvalidArgument, x.QuotaResetZone, err)
+	}
+
+	quota.SetResetLocation(location)
+
+	state, err := serve.LoadState(x.StateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	quota.Restore(state.Quota, time.Now())
+	x.config.AddRequestHook(quota.ObserveRequest)
+
+	return state, quota, nil
+}
+
+func (x *RawCommand) body() (json.RawMessage, error) {
+	if x.Data == "" {
+		return nil, nil
+	}
+
+	data := []byte(x.Data)
+
+	if fileName, ok := strings.CutPrefix(x.Data, "@"); ok {
+		contents, err := util.FromFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+
+		data = contents
+	}
+
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%w: request body is not valid JSON", ErrInvalidArgument)
+	}
+
+	return json.RawMessage(data), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestRawBodyFromArgument(t *testing.T) {
+	t.Parallel()
+
+	subject := &RawCommand{Data: `{"sn":"1234"}`} //nolint:exhaustruct
+
+	body, err := subject.body()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"sn":"1234"}`, string(body))
+}
+
+func TestRawBodyFromFile(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "body.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(`{"currentPage":1}`), 0o600))
+
+	subject := &RawCommand{Data: "@" + fileName} //nolint:exhaustruct
+
+	body, err := subject.body()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"currentPage":1}`, string(body))
+}
+
+func TestRawBodyIsOptional(t *testing.T) {
+	t.Parallel()
+
+	subject := &RawCommand{} //nolint:exhaustruct
+
+	body, err := subject.body()
+	require.NoError(t, err)
+	assert.Equal(t, json.RawMessage(nil), body)
+}
+
+func TestRawBodyMustBeJSON(t *testing.T) {
+	t.Parallel()
+
+	subject := &RawCommand{Data: "{not json"} //nolint:exhaustruct
+
+	_, err := subject.body()
+	require.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestRawCallIsRecordedAgainstTheQuota(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/op/v0/device/list", r.URL.Path, "only the requested call is made")
+		_, _ = w.Write([]byte(`{"errno":0,"result":{"total":0,"data":[]}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	now := time.Now()
+	state := &serve.State{
+		Energy:   nil,
+		RealTime: nil,
+		Devices:  []foxess.Device{{DeviceSerialNumber: "SN1"}}, //nolint:exhaustruct
+		Quota:    &serve.QuotaState{Total: 1440, Remaining: 1000, PercentageUsed: 30.56, ObservedAt: now, BaselineTime: now, BaselineUsed: 440},
+		Polls:    nil,
+	}
+
+	subject := &RawCommand{ShowUsage: true, StateFile: filepath.Join(t.TempDir(), "state.json"), QuotaResetZone: "UTC"} //nolint:exhaustruct
+	subject.Args.Method, subject.Args.Path = "POST", "/op/v0/device/list"
+	subject.config = &foxess.Config{Client: redirect(server)} //nolint:exhaustruct
+	require.NoError(t, state.Save(subject.StateFile))
+
+	require.NoError(t, subject.Execute(nil))
+
+	saved, err := serve.LoadState(subject.StateFile)
+	require.NoError(t, err)
+	require.NotNil(t, saved.Quota)
+	assert.InDelta(t, 999, saved.Quota.Remaining, 0)
+	assert.InDelta(t, 440, saved.Quota.BaselineUsed, 0)
+	assert.Equal(t, state.Devices, saved.Devices, "the rest of the state is kept")
+}
+
+func TestRawUsageNeedsAStateFile(t *testing.T) {
+	t.Parallel()
+
+	subject := &RawCommand{ShowUsage: true} //nolint:exhaustruct
+	subject.Args.Method, subject.Args.Path = "GET", "/op/v0/user/getAccessCount"
+
+	require.ErrorIs(t, subject.Execute(nil), ErrInvalidArgument)
+}
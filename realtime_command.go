@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/rodaine/table"
@@ -24,10 +25,18 @@ func (x *RealTimeCommand) Register(parser *flags.Parser, config *foxess.Config)
 	x.config = config
 }
 
+func (x *RealTimeCommand) RequiresAPIKey() bool {
+	return true
+}
+
 func (x *RealTimeCommand) Execute(_ []string) error {
 	data, err := x.config.GetRealTimeData(x.Inverters, x.Variables)
 	if err != nil {
-		return fmt.Errorf("unable to retrieve real-time data from FoxESS: %w", err)
+		if len(data) == 0 {
+			return fmt.Errorf("unable to retrieve real-time data from FoxESS: %w", err)
+		}
+
+		log.Printf("Unable to retrieve some real-time data: %v", err)
 	}
 
 	switch x.Format {
@@ -2,36 +2,204 @@ package serve
 
 import (
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/teh-hippo/foxess-exporter/foxess"
 )
 
 type APIQuota struct {
-	value *foxess.APIUsage
-	cond  *sync.Cond
+	value         *foxess.APIUsage
+	cond          *sync.Cond
+	resetLocation *time.Location
+	observedAt    time.Time
+	baseline      quotaObservation
+	rate          float64
+	descs         quotaDescs
+	closed        bool
+}
+
+// quotaObservation is the first usage seen since the quota last reset, from which the consumption rate is measured.
+type quotaObservation struct {
+	time time.Time
+	used float64
+}
+
+type quotaDescs struct {
+	total      *prometheus.Desc
+	remaining  *prometheus.Desc
+	usedRatio  *prometheus.Desc
+	rate       *prometheus.Desc
+	reset      *prometheus.Desc
+	exhaustion *prometheus.Desc
 }
 
 func NewAPIQuota() *APIQuota {
 	return &APIQuota{
-		cond:  sync.NewCond(&sync.Mutex{}),
-		value: nil,
+		cond:          sync.NewCond(&sync.Mutex{}),
+		value:         nil,
+		resetLocation: time.Local,
+		observedAt:    time.Time{},
+		baseline:      quotaObservation{time: time.Time{}, used: 0},
+		rate:          0,
+		closed:        false,
+		descs: quotaDescs{
+			total:      prometheus.NewDesc("foxess_api_quota_total", "Daily allowance of FoxESS API calls.", nil, nil),
+			remaining:  prometheus.NewDesc("foxess_api_quota_remaining", "FoxESS API calls remaining today.", nil, nil),
+			usedRatio:  prometheus.NewDesc("foxess_api_quota_used_ratio", "Proportion of the daily FoxESS API allowance used.", nil, nil),
+			rate:       prometheus.NewDesc("foxess_api_quota_consumption_rate", "FoxESS API calls consumed per second since the quota last reset.", nil, nil),
+			reset:      prometheus.NewDesc("foxess_api_quota_reset_timestamp_seconds", "Time the FoxESS API quota next resets.", nil, nil),
+			exhaustion: prometheus.NewDesc("foxess_api_quota_exhaustion_timestamp_seconds", "Projected time the FoxESS API quota runs out at the current consumption rate.", nil, nil),
+		},
 	}
 }
 
+// SetResetLocation sets the time zone in whose midnight the daily quota resets.
+func (x *APIQuota) SetResetLocation(location *time.Location) {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+	x.resetLocation = location
+}
+
 func (x *APIQuota) Set(value *foxess.APIUsage) {
+	x.SetAt(value, time.Now())
+}
+
+func (x *APIQuota) SetAt(value *foxess.APIUsage, now time.Time) {
 	x.cond.L.Lock()
 	defer x.cond.L.Unlock()
+
+	used := value.Total - value.Remaining
+	reset := x.value == nil || used < x.baseline.used || !now.Before(x.nextReset(x.baseline.time))
+
+	if reset {
+		x.baseline = quotaObservation{time: now, used: used}
+		x.rate = 0
+	} else if elapsed := now.Sub(x.baseline.time).Seconds(); elapsed > 0 {
+		x.rate = (used - x.baseline.used) / elapsed
+	}
+
 	x.value = value
+	x.observedAt = now
 	x.cond.Broadcast()
 }
 
-func (x *APIQuota) IsQuotaAvailable() bool {
+// ObserveRequest counts a request that reached FoxESS against the known usage, until FoxESS next reports it.
+func (x *APIQuota) ObserveRequest(event *foxess.RequestEvent) {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+
+	if x.value == nil || event.Outcome == foxess.OutcomeRequestFailure {
+		return
+	}
+
+	remaining := max(x.value.Remaining-1, 0)
+	x.value = &foxess.APIUsage{Total: x.value.Total, Remaining: remaining, PercentageUsed: (x.value.Total - remaining) / x.value.Total * foxess.PERCENT}
+}
+
+// Snapshot captures the latest usage, if known, to persist across restarts.
+func (x *APIQuota) Snapshot() *QuotaState {
 	x.cond.L.Lock()
 	defer x.cond.L.Unlock()
 
 	if x.value == nil {
+		return nil
+	}
+
+	return &QuotaState{
+		Total:          x.value.Total,
+		Remaining:      x.value.Remaining,
+		PercentageUsed: x.value.PercentageUsed,
+		ObservedAt:     x.observedAt,
+		BaselineTime:   x.baseline.time,
+		BaselineUsed:   x.baseline.used,
+	}
+}
+
+// Restore reinstates persisted usage, reporting false when it is unknown, has since reset, or newer usage is known.
+func (x *APIQuota) Restore(state *QuotaState, now time.Time) bool {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+
+	if state == nil || x.value != nil || !now.Before(x.nextReset(state.ObservedAt)) {
+		return false
+	}
+
+	x.value = &foxess.APIUsage{Total: state.Total, Remaining: state.Remaining, PercentageUsed: state.PercentageUsed}
+	x.observedAt = state.ObservedAt
+	x.baseline = quotaObservation{time: state.BaselineTime, used: state.BaselineUsed}
+
+	if elapsed := state.ObservedAt.Sub(state.BaselineTime).Seconds(); elapsed > 0 {
+		x.rate = (state.Total - state.Remaining - state.BaselineUsed) / elapsed
+	}
+
+	x.cond.Broadcast()
+
+	return true
+}
+
+// Current returns the latest usage, if known, and when the quota next resets.
+func (x *APIQuota) Current() (*foxess.APIUsage, time.Time) {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+
+	return x.value, x.nextReset(x.observedAt)
+}
+
+func (x *APIQuota) IsQuotaAvailable() bool {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+
+	for x.value == nil && !x.closed {
 		x.cond.Wait()
 	}
 
-	return x.value.Remaining > 0
+	return x.value != nil && x.value.Remaining > 0
+}
+
+// Close releases anything waiting in IsQuotaAvailable, which then reports no quota if none has been set.
+func (x *APIQuota) Close() {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+	x.closed = true
+	x.cond.Broadcast()
+}
+
+func (x *APIQuota) Describe(ch chan<- *prometheus.Desc) {
+	ch <- x.descs.total
+	ch <- x.descs.remaining
+	ch <- x.descs.usedRatio
+	ch <- x.descs.rate
+	ch <- x.descs.reset
+	ch <- x.descs.exhaustion
+}
+
+func (x *APIQuota) Collect(ch chan<- prometheus.Metric) {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+
+	if x.value == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(x.descs.total, prometheus.GaugeValue, x.value.Total)
+	ch <- prometheus.MustNewConstMetric(x.descs.remaining, prometheus.GaugeValue, x.value.Remaining)
+	ch <- prometheus.MustNewConstMetric(x.descs.usedRatio, prometheus.GaugeValue, x.value.PercentageUsed/foxess.PERCENT)
+	ch <- prometheus.MustNewConstMetric(x.descs.rate, prometheus.GaugeValue, x.rate)
+	reset := x.nextReset(x.observedAt)
+	ch <- prometheus.MustNewConstMetric(x.descs.reset, prometheus.GaugeValue, float64(reset.Unix()))
+
+	// The quota only runs out if it does so before it resets.
+	if x.rate > 0 {
+		exhaustion := x.observedAt.Add(time.Duration(x.value.Remaining / x.rate * float64(time.Second)))
+		if exhaustion.Before(reset) {
+			ch <- prometheus.MustNewConstMetric(x.descs.exhaustion, prometheus.GaugeValue, float64(exhaustion.Unix()))
+		}
+	}
+}
+
+func (x *APIQuota) nextReset(after time.Time) time.Time {
+	local := after.In(x.resetLocation)
+
+	return time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, x.resetLocation)
 }
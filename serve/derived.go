@@ -0,0 +1,131 @@
+package serve
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Derivations are expressions over the real-time variables of an inverter, keyed by the name they are exported as.
+type Derivations map[string]*Expression
+
+// DefaultDerivations are the built-in energy flows, in the units FoxESS reports power (kW), or as ratios.
+func DefaultDerivations() map[string]string {
+	return map[string]string{
+		"houseLoad":       "pvPower + gridConsumptionPower + batDischargePower - feedinPower - batChargePower",
+		"selfConsumption": "(pvPower - feedinPower) / pvPower",
+		"selfSufficiency": "1 - gridConsumptionPower / loadsPower",
+		"batteryNet":      "batDischargePower - batChargePower",
+		"gridNet":         "gridConsumptionPower - feedinPower",
+	}
+}
+
+// ParseDerivations parses the expressions applied over the defaults. An empty expression removes the default of the
+// same name.
+func ParseDerivations(overrides map[string]string) (Derivations, error) {
+	sources := DefaultDerivations()
+	maps.Copy(sources, overrides)
+
+	derivations := make(Derivations, len(sources))
+
+	for name, source := range sources {
+		if source == "" {
+			continue
+		}
+
+		expression, err := ParseExpression(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+
+		derivations[name] = expression
+	}
+
+	return derivations, nil
+}
+
+// derivedCollector exports the derivations of each inverter's latest real-time data.
+type derivedCollector struct {
+	mutex       sync.RWMutex
+	desc        *prometheus.Desc
+	derivations Derivations
+	samples     map[string]map[string]sample
+	timestamps  bool
+}
+
+func newDerivedCollector(settings *options) *derivedCollector {
+	derivations, err := ParseDerivations(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return &derivedCollector{
+		mutex:       sync.RWMutex{},
+		desc:        prometheus.NewDesc("foxess_derived_data", "Energy flows derived from the FoxESS data.", []string{"inverter", "variable"}, nil),
+		derivations: derivations,
+		samples:     make(map[string]map[string]sample),
+		timestamps:  settings.timestamps,
+	}
+}
+
+func (c *derivedCollector) configure(derivations Derivations) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.derivations = derivations
+
+	for _, samples := range c.samples {
+		for name := range samples {
+			if _, ok := derivations[name]; !ok {
+				delete(samples, name)
+			}
+		}
+	}
+}
+
+// update replaces the derivations of the inverter, leaving out any whose variables are missing or whose result is
+// undefined.
+func (c *derivedCollector) update(inverter string, values map[string]float64, at time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	samples := make(map[string]sample, len(c.derivations))
+
+	for name, expression := range c.derivations {
+		if value, ok := expression.Evaluate(values); ok {
+			samples[name] = sample{value: value, time: at, seen: at}
+		}
+	}
+
+	c.samples[inverter] = samples
+}
+
+func (c *derivedCollector) remove(inverter string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.samples, inverter)
+}
+
+func (c *derivedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *derivedCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for inverter, samples := range c.samples {
+		for name, latest := range samples {
+			metric := prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, latest.value, inverter, name)
+			if c.timestamps {
+				metric = prometheus.NewMetricWithTimestamp(latest.time, metric)
+			}
+
+			ch <- metric
+		}
+	}
+}
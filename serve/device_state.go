@@ -0,0 +1,139 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+const (
+	StateOnline  = "online"
+	StateFault   = "fault"
+	StateOffline = "offline"
+	StateUnknown = "unknown"
+)
+
+// States are the values of the state label, in the order FoxESS numbers them.
+var States = []string{StateOnline, StateFault, StateOffline, StateUnknown}
+
+// StateName is the state label for a FoxESS device status.
+func StateName(status int) string {
+	switch status {
+	case foxess.StatusOnline:
+		return StateOnline
+	case foxess.StatusFault:
+		return StateFault
+	case foxess.StatusOffline:
+		return StateOffline
+	default:
+		return StateUnknown
+	}
+}
+
+type deviceState struct {
+	device      foxess.Device
+	state       string
+	since       time.Time
+	durations   map[string]time.Duration
+	transitions map[[2]string]float64
+}
+
+// deviceStateCollector exports the state of each device as a state set, along with how often it has changed state and
+// how long it has spent in each.
+type deviceStateCollector struct {
+	mutex       sync.RWMutex
+	state       *prometheus.Desc
+	transitions *prometheus.Desc
+	duration    *prometheus.Desc
+	devices     map[string]*deviceState
+	now         func() time.Time
+}
+
+func newDeviceStateCollector(settings *options) *deviceStateCollector {
+	return &deviceStateCollector{
+		mutex: sync.RWMutex{},
+		state: prometheus.NewDesc("foxess_device_state", "Whether the inverter is in the state, with details from the device list.",
+			[]string{"inverter", "state", "station_name", "product_type", "device_type"}, nil),
+		transitions: prometheus.NewDesc("foxess_device_state_transitions_total", "Number of times the inverter changed state.",
+			[]string{"inverter", "from", "to"}, nil),
+		duration: prometheus.NewDesc("foxess_device_state_seconds_total", "Time the inverter has spent in the state.",
+			[]string{"inverter", "state"}, nil),
+		devices: make(map[string]*deviceState),
+		now:     settings.now,
+	}
+}
+
+func (c *deviceStateCollector) update(device *foxess.Device) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	state := StateName(device.Status)
+
+	current, ok := c.devices[device.DeviceSerialNumber]
+	if !ok {
+		c.devices[device.DeviceSerialNumber] = &deviceState{
+			device:      *device,
+			state:       state,
+			since:       now,
+			durations:   make(map[string]time.Duration),
+			transitions: make(map[[2]string]float64),
+		}
+
+		return
+	}
+
+	current.device = *device
+
+	if current.state != state {
+		current.durations[current.state] += now.Sub(current.since)
+		current.transitions[[2]string{current.state, state}]++
+		current.state = state
+		current.since = now
+	}
+}
+
+func (c *deviceStateCollector) remove(inverter string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.devices, inverter)
+}
+
+func (c *deviceStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+	ch <- c.transitions
+	ch <- c.duration
+}
+
+func (c *deviceStateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	now := c.now()
+
+	for inverter, current := range c.devices {
+		for _, state := range States {
+			value := 0.0
+			if state == current.state {
+				value = 1
+			}
+
+			ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, value,
+				inverter, state, current.device.StationName, current.device.ProductType, current.device.DeviceType)
+
+			duration := current.durations[state]
+			if state == current.state {
+				duration += now.Sub(current.since)
+			}
+
+			ch <- prometheus.MustNewConstMetric(c.duration, prometheus.CounterValue, duration.Seconds(), inverter, state)
+		}
+
+		for transition, count := range current.transitions {
+			ch <- prometheus.MustNewConstMetric(c.transitions, prometheus.CounterValue, count, inverter, transition[0], transition[1])
+		}
+	}
+}
@@ -7,12 +7,14 @@ import (
 type DeviceCache struct {
 	DeviceIDs []string
 	cond      *sync.Cond
+	closed    bool
 }
 
 func NewDeviceCache() *DeviceCache {
 	return &DeviceCache{
 		cond:      sync.NewCond(&sync.Mutex{}),
 		DeviceIDs: nil,
+		closed:    false,
 	}
 }
 
@@ -27,9 +29,25 @@ func (x *DeviceCache) Get() []string {
 	x.cond.L.Lock()
 	defer x.cond.L.Unlock()
 
-	if x.DeviceIDs == nil {
+	for x.DeviceIDs == nil && !x.closed {
 		x.cond.Wait()
 	}
 
 	return x.DeviceIDs
 }
+
+// Close releases anything waiting in Get, which then returns nil if no devices have been set.
+func (x *DeviceCache) Close() {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+	x.closed = true
+	x.cond.Broadcast()
+}
+
+// Peek returns the current device IDs without waiting for them to be set.
+func (x *DeviceCache) Peek() []string {
+	x.cond.L.Lock()
+	defer x.cond.L.Unlock()
+
+	return x.DeviceIDs
+}
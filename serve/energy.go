@@ -0,0 +1,148 @@
+package serve
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+// Integral is the energy accumulated from a power variable, along with the last sample integrated.
+type Integral struct {
+	KiloWattHours float64   `json:"kwh"`
+	LastValue     float64   `json:"lastValue"`
+	LastTime      time.Time `json:"lastTime"`
+}
+
+// integrate adds the area between the last sample and this one, in kW over hours, unless they are further apart than
+// maxGap. Negative power counts as zero so that the total never decreases.
+func (x *Integral) integrate(value float64, at time.Time, maxGap time.Duration) {
+	value = max(value, 0)
+
+	if !x.LastTime.IsZero() {
+		if !at.After(x.LastTime) {
+			return
+		}
+
+		if gap := at.Sub(x.LastTime); gap <= maxGap {
+			x.KiloWattHours += (x.LastValue + value) / 2 * gap.Hours()
+		}
+	}
+
+	x.LastValue = value
+	x.LastTime = at
+}
+
+// energyCollector integrates selected power variables over the time FoxESS recorded them, exporting the energy as
+// counters.
+type energyCollector struct {
+	mutex     sync.RWMutex
+	joules    *prometheus.Desc
+	kwh       *prometheus.Desc
+	variables []string
+	maxGap    time.Duration
+	integrals map[string]map[string]*Integral
+}
+
+func newEnergyCollector() *energyCollector {
+	return &energyCollector{
+		mutex:     sync.RWMutex{},
+		joules:    prometheus.NewDesc("foxess_integrated_energy_joules_total", "Energy integrated from a FoxESS power variable.", []string{"inverter", "variable"}, nil),
+		kwh:       prometheus.NewDesc("foxess_integrated_energy_kwh_total", "Energy integrated from a FoxESS power variable, in kWh.", []string{"inverter", "variable"}, nil),
+		variables: nil,
+		maxGap:    0,
+		integrals: make(map[string]map[string]*Integral),
+	}
+}
+
+func (c *energyCollector) configure(variables []string, maxGap time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.variables = variables
+	c.maxGap = maxGap
+}
+
+func (c *energyCollector) update(data *foxess.RealTimeData) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, variable := range data.Variables {
+		if !slices.Contains(c.variables, variable.Variable) {
+			continue
+		}
+
+		power, ok := kiloWatts(variable.Value.Number, variable.Unit)
+		if !ok {
+			continue
+		}
+
+		integrals, ok := c.integrals[data.DeviceSN]
+		if !ok {
+			integrals = make(map[string]*Integral)
+			c.integrals[data.DeviceSN] = integrals
+		}
+
+		integral, ok := integrals[variable.Variable]
+		if !ok {
+			integral = &Integral{KiloWattHours: 0, LastValue: 0, LastTime: time.Time{}}
+			integrals[variable.Variable] = integral
+		}
+
+		integral.integrate(power, data.Time.Time, c.maxGap)
+	}
+}
+
+// kiloWatts converts power reported in W or kW to kW. Any other unit is not power, so is not integrated.
+func kiloWatts(value float64, unit string) (float64, bool) {
+	factor, ok := powerUnits[unit]
+
+	return value * factor, ok
+}
+
+func (c *energyCollector) snapshot() map[string]map[string]Integral {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	snapshot := make(map[string]map[string]Integral, len(c.integrals))
+
+	for inverter, integrals := range c.integrals {
+		snapshot[inverter] = make(map[string]Integral, len(integrals))
+		for variable, integral := range integrals {
+			snapshot[inverter][variable] = *integral
+		}
+	}
+
+	return snapshot
+}
+
+func (c *energyCollector) restore(snapshot map[string]map[string]Integral) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for inverter, integrals := range snapshot {
+		c.integrals[inverter] = make(map[string]*Integral, len(integrals))
+		for variable, integral := range integrals {
+			c.integrals[inverter][variable] = &integral
+		}
+	}
+}
+
+func (c *energyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.joules
+	ch <- c.kwh
+}
+
+func (c *energyCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for inverter, integrals := range c.integrals {
+		for variable, integral := range integrals {
+			ch <- prometheus.MustNewConstMetric(c.joules, prometheus.CounterValue, integral.KiloWattHours*kiloWattHour, inverter, variable)
+			ch <- prometheus.MustNewConstMetric(c.kwh, prometheus.CounterValue, integral.KiloWattHours, inverter, variable)
+		}
+	}
+}
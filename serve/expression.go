@@ -0,0 +1,293 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"unicode"
+)
+
+var ErrInvalidExpression = errors.New("invalid expression")
+
+// Expression is arithmetic over FoxESS variables, supporting + - * /, parentheses, numbers and the functions min,
+// max and abs.
+type Expression struct {
+	source    string
+	root      node
+	variables []string
+}
+
+type node interface {
+	eval(values map[string]float64) (float64, bool)
+}
+
+type (
+	number   float64
+	variable string
+	negate   struct{ operand node }
+	binary   struct {
+		op          byte
+		left, right node
+	}
+	call struct {
+		name string
+		args []node
+	}
+)
+
+var functions = map[string]func(args []float64) float64{
+	"min": func(args []float64) float64 { return slices.Min(args) },
+	"max": func(args []float64) float64 { return slices.Max(args) },
+	"abs": func(args []float64) float64 { return math.Abs(args[0]) },
+}
+
+func ParseExpression(source string) (*Expression, error) {
+	parser := &expressionParser{source: source, position: 0, variables: nil}
+
+	root, err := parser.expression()
+	if err == nil && parser.peek() != 0 {
+		err = parser.errorf("unexpected '%c'", parser.peek())
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w '%s': %w", ErrInvalidExpression, source, err)
+	}
+
+	return &Expression{source: source, root: root, variables: parser.variables}, nil
+}
+
+// Evaluate computes the expression, reporting false when a variable is missing or the result is undefined, such as
+// after dividing by zero.
+func (e *Expression) Evaluate(values map[string]float64) (float64, bool) {
+	result, ok := e.root.eval(values)
+
+	return result, ok && !math.IsNaN(result) && !math.IsInf(result, 0)
+}
+
+// Variables are the FoxESS variables the expression refers to.
+func (e *Expression) Variables() []string {
+	return e.variables
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+func (n number) eval(map[string]float64) (float64, bool) {
+	return float64(n), true
+}
+
+func (n variable) eval(values map[string]float64) (float64, bool) {
+	value, ok := values[string(n)]
+
+	return value, ok
+}
+
+func (n *negate) eval(values map[string]float64) (float64, bool) {
+	value, ok := n.operand.eval(values)
+
+	return -value, ok
+}
+
+func (n *binary) eval(values map[string]float64) (float64, bool) {
+	left, ok := n.left.eval(values)
+	if !ok {
+		return 0, false
+	}
+
+	right, ok := n.right.eval(values)
+	if !ok {
+		return 0, false
+	}
+
+	switch n.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	default:
+		return left / right, right != 0
+	}
+}
+
+func (n *call) eval(values map[string]float64) (float64, bool) {
+	args := make([]float64, len(n.args))
+
+	for i, arg := range n.args {
+		value, ok := arg.eval(values)
+		if !ok {
+			return 0, false
+		}
+
+		args[i] = value
+	}
+
+	return functions[n.name](args), true
+}
+
+// expressionParser is a recursive descent parser of the grammar:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/") unary }
+//	unary      = "-" unary | primary
+//	primary    = number | identifier [ "(" expression { "," expression } ")" ] | "(" expression ")"
+type expressionParser struct {
+	source    string
+	position  int
+	variables []string
+}
+
+func (p *expressionParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at position %d: %s", p.position+1, fmt.Sprintf(format, args...))
+}
+
+// peek skips whitespace and returns the next character, or 0 at the end.
+func (p *expressionParser) peek() byte {
+	for p.position < len(p.source) && unicode.IsSpace(rune(p.source[p.position])) {
+		p.position++
+	}
+
+	if p.position == len(p.source) {
+		return 0
+	}
+
+	return p.source[p.position]
+}
+
+func (p *expressionParser) expression() (node, error) {
+	left, err := p.term()
+
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.source[p.position]
+		p.position++
+
+		var right node
+		right, err = p.term()
+		left = &binary{op: op, left: left, right: right}
+	}
+
+	return left, err
+}
+
+func (p *expressionParser) term() (node, error) {
+	left, err := p.unary()
+
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.source[p.position]
+		p.position++
+
+		var right node
+		right, err = p.unary()
+		left = &binary{op: op, left: left, right: right}
+	}
+
+	return left, err
+}
+
+func (p *expressionParser) unary() (node, error) {
+	if p.peek() != '-' {
+		return p.primary()
+	}
+
+	p.position++
+	operand, err := p.unary()
+
+	return &negate{operand: operand}, err
+}
+
+func (p *expressionParser) primary() (node, error) {
+	next := p.peek()
+
+	switch {
+	case next == '(':
+		p.position++
+
+		inner, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		return inner, p.expect(')')
+	case next == '.' || unicode.IsDigit(rune(next)):
+		return p.number()
+	case next == '_' || unicode.IsLetter(rune(next)):
+		return p.identifier()
+	case next == 0:
+		return nil, p.errorf("unexpected end")
+	default:
+		return nil, p.errorf("unexpected '%c'", next)
+	}
+}
+
+func (p *expressionParser) number() (node, error) {
+	start := p.position
+	for p.position < len(p.source) && (p.source[p.position] == '.' || unicode.IsDigit(rune(p.source[p.position]))) {
+		p.position++
+	}
+
+	value, err := strconv.ParseFloat(p.source[start:p.position], 64)
+	if err != nil {
+		return nil, p.errorf("invalid number '%s'", p.source[start:p.position])
+	}
+
+	return number(value), nil
+}
+
+func (p *expressionParser) identifier() (node, error) {
+	start := p.position
+	for p.position < len(p.source) && (p.source[p.position] == '_' || unicode.IsLetter(rune(p.source[p.position])) || unicode.IsDigit(rune(p.source[p.position]))) {
+		p.position++
+	}
+
+	name := p.source[start:p.position]
+	if p.peek() != '(' {
+		if !slices.Contains(p.variables, name) {
+			p.variables = append(p.variables, name)
+		}
+
+		return variable(name), nil
+	}
+
+	if _, ok := functions[name]; !ok {
+		return nil, p.errorf("unknown function '%s'", name)
+	}
+
+	p.position++
+
+	var args []node
+
+	for {
+		arg, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+
+		if p.peek() != ',' {
+			break
+		}
+
+		p.position++
+	}
+
+	if name == "abs" && len(args) != 1 {
+		return nil, p.errorf("abs takes a single argument")
+	}
+
+	return &call{name: name, args: args}, p.expect(')')
+}
+
+func (p *expressionParser) expect(char byte) error {
+	if p.peek() != char {
+		return p.errorf("expected '%c'", char)
+	}
+
+	p.position++
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/util"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusReady    = "ready"
+	StatusNotReady = "not ready"
+)
+
+type Check struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type HealthResponse struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+// Health reports whether the exporter is alive, and whether it is ready: the device list and quota are known, and
+// real-time data has been polled recently.
+type Health struct {
+	devices  *DeviceCache
+	quota    *APIQuota
+	maxAge   func() time.Duration
+	now      func() time.Time
+	lastPoll atomic.Int64
+	onScrape bool
+}
+
+func NewHealth(devices *DeviceCache, quota *APIQuota, maxAge func() time.Duration) *Health {
+	return &Health{
+		devices:  devices,
+		quota:    quota,
+		maxAge:   maxAge,
+		now:      time.Now,
+		lastPoll: atomic.Int64{},
+		onScrape: false,
+	}
+}
+
+// FetchOnScrape bases readiness on the device list and quota alone, as real-time data is then only fetched when
+// scraped, which needs the pod to be ready in the first place.
+func (x *Health) FetchOnScrape() {
+	x.onScrape = true
+}
+
+// RealTimePolled records a successful real-time poll.
+func (x *Health) RealTimePolled(at time.Time) {
+	x.lastPoll.Store(at.UnixNano())
+}
+
+func (x *Health) Liveness(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, &HealthResponse{Status: StatusOK, Checks: nil})
+}
+
+func (x *Health) Readiness(w http.ResponseWriter, _ *http.Request) {
+	response := &HealthResponse{Status: StatusReady, Checks: x.checks()}
+	status := http.StatusOK
+
+	for _, check := range response.Checks {
+		if !check.OK {
+			response.Status = StatusNotReady
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	writeHealth(w, status, response)
+}
+
+func (x *Health) checks() map[string]Check {
+	checks := make(map[string]Check, 3) //nolint:mnd
+
+	if devices := x.devices.Peek(); devices == nil {
+		checks["devices"] = Check{OK: false, Detail: "device list not loaded"}
+	} else {
+		checks["devices"] = Check{OK: true, Detail: fmt.Sprintf("%d device%s", len(devices), util.Pluralise(len(devices)))}
+	}
+
+	if usage, _ := x.quota.Current(); usage == nil {
+		checks["quota"] = Check{OK: false, Detail: "API quota unknown"}
+	} else {
+		checks["quota"] = Check{OK: true, Detail: fmt.Sprintf("%.0f/%.0f remaining", usage.Remaining, usage.Total)}
+	}
+
+	lastPoll := x.lastPoll.Load()
+	age := x.now().Sub(time.Unix(0, lastPoll)).Round(time.Second)
+	maxAge := x.maxAge()
+
+	switch {
+	case x.onScrape && lastPoll == 0:
+		checks["realtime"] = Check{OK: true, Detail: "fetched on scrape, none yet"}
+	case x.onScrape:
+		checks["realtime"] = Check{OK: true, Detail: fmt.Sprintf("fetched on scrape, last %v ago", age)}
+	case lastPoll == 0:
+		checks["realtime"] = Check{OK: false, Detail: "no real-time data polled yet"}
+	case age > maxAge:
+		checks["realtime"] = Check{OK: false, Detail: fmt.Sprintf("last polled %v ago, more than %v", age, maxAge)}
+	default:
+		checks["realtime"] = Check{OK: true, Detail: fmt.Sprintf("last polled %v ago", age)}
+	}
+
+	return checks
+}
+
+func writeHealth(w http.ResponseWriter, status int, response *HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Unable to write health response: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teh-hippo/foxess-exporter/util"
+)
+
+const (
+	// DefaultDailyQuota is the FoxESS allowance assumed until the actual quota is known.
+	DefaultDailyQuota = 1440
+	// QuotaInterval is how often the quota itself is checked, which also consumes calls.
+	QuotaInterval = 10 * time.Minute
+	// quotaHeadroom is the proportion of the remaining quota held back from adaptive polling.
+	quotaHeadroom = 0.1
+	maxInterval   = 24 * time.Hour
+)
+
+// Intervals holds the effective polling intervals, which adapt to the remaining API quota when enabled.
+type Intervals struct {
+	mutex     sync.RWMutex
+	realTime  time.Duration
+	status    time.Duration
+	effective map[string]time.Duration
+	floor     time.Duration
+	adaptive  bool
+	changed   chan struct{}
+	desc      *prometheus.Desc
+}
+
+func NewIntervals(realTime, status, floor time.Duration, adaptive bool) *Intervals {
+	return &Intervals{
+		mutex:     sync.RWMutex{},
+		realTime:  realTime,
+		status:    status,
+		effective: map[string]time.Duration{JobRealTime: realTime, JobStatus: status},
+		floor:     floor,
+		adaptive:  adaptive,
+		changed:   make(chan struct{}),
+		desc:      prometheus.NewDesc("foxess_poll_interval_seconds", "Effective interval between polls.", []string{"job"}, nil),
+	}
+}
+
+func (x *Intervals) RealTime() time.Duration {
+	return x.get(JobRealTime)
+}
+
+func (x *Intervals) Status() time.Duration {
+	return x.get(JobStatus)
+}
+
+func (x *Intervals) get(job string) time.Duration {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	return x.effective[job]
+}
+
+// Changed returns a channel that is closed when the effective intervals next change, so that a poll waiting on the
+// previous interval can be rescheduled.
+func (x *Intervals) Changed() <-chan struct{} {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	return x.changed
+}
+
+// set updates an effective interval, waking those waiting on Changed if it differs.
+func (x *Intervals) set(job string, interval time.Duration) {
+	if x.effective[job] == interval {
+		return
+	}
+
+	x.effective[job] = interval
+	close(x.changed)
+	x.changed = make(chan struct{})
+}
+
+// Recalculate spreads the remaining quota over the time until it resets. The configured intervals are scaled by how
+// far the calls they would make exceed (or fall short of) what is available, and clamped to the floor. Neither is
+// longer than the time until the reset, when the quota is replenished, even if none is available until then.
+func (x *Intervals) Recalculate(remaining float64, untilReset time.Duration, batches int) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if !x.adaptive || untilReset <= 0 {
+		return
+	}
+
+	window := untilReset.Seconds()
+	budget := remaining*(1-quotaHeadroom) - window/QuotaInterval.Seconds()
+	demand := window/x.realTime.Seconds()*float64(max(batches, 1)) + window/x.status.Seconds()
+
+	realTime, status := untilReset, untilReset
+
+	if budget > 0 {
+		factor := demand / budget
+		realTime = time.Duration(float64(x.realTime) * factor)
+		status = time.Duration(float64(x.status) * factor)
+	}
+
+	x.set(JobRealTime, util.Clamp(min(realTime, untilReset), x.floor, maxInterval))
+	x.set(JobStatus, util.Clamp(min(status, untilReset), x.floor, maxInterval))
+}
+
+// Configure replaces the configured intervals, which take effect immediately until the next recalculation.
+func (x *Intervals) Configure(realTime, status, floor time.Duration, adaptive bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.realTime, x.status, x.floor, x.adaptive = realTime, status, floor, adaptive
+	x.set(JobRealTime, realTime)
+	x.set(JobStatus, status)
+}
+
+func (x *Intervals) Describe(ch chan<- *prometheus.Desc) {
+	ch <- x.desc
+}
+
+func (x *Intervals) Collect(ch chan<- prometheus.Metric) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	for job, interval := range x.effective {
+		ch <- prometheus.MustNewConstMetric(x.desc, prometheus.GaugeValue, interval.Seconds(), job)
+	}
+}
@@ -0,0 +1,244 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teh-hippo/foxess-exporter/util"
+	"gopkg.in/yaml.v3"
+)
+
+type MetricType string
+
+const (
+	MetricTypeGauge   MetricType = "gauge"
+	MetricTypeCounter MetricType = "counter"
+)
+
+const (
+	kiloWatt     = 1000
+	kiloWattHour = 3.6e6
+	percent      = 0.01
+)
+
+var (
+	ErrInvalidMapping = errors.New("invalid metric mapping")
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+)
+
+// reservedPrefixes are those of the Go runtime and process metrics, which vary between versions of Go.
+var reservedPrefixes = []string{"go_", "process_"}
+
+// derivedSuffixes are those of the series a histogram or summary derives from its name.
+var derivedSuffixes = []string{"_bucket", "_sum", "_count"}
+
+// powerUnits and energyUnits are the units FoxESS may report power and energy in, by their size in kW and kWh.
+var (
+	powerUnits   = map[string]float64{"kW": 1, "W": 1.0 / kiloWatt}
+	energyUnits  = map[string]float64{"kWh": 1, "Wh": 1.0 / kiloWatt}
+	unitFamilies = []map[string]float64{powerUnits, energyUnits}
+)
+
+// Mapping describes how a FoxESS variable is exported as its own Prometheus metric. Scale converts from the Source
+// unit, when given, so values FoxESS reports in another unit of the same kind are converted, and others are skipped.
+type Mapping struct {
+	Name   string     `yaml:"name"`
+	Type   MetricType `yaml:"type"`
+	Unit   string     `yaml:"unit"`
+	Source string     `yaml:"source"`
+	Scale  float64    `yaml:"scale"`
+	Help   string     `yaml:"help"`
+}
+
+// Mappings are keyed by FoxESS variable name.
+type Mappings map[string]Mapping
+
+func DefaultMappings() Mappings {
+	return Mappings{
+		"pvPower":              power("foxess_pv_power_watts", "PV power."),
+		"generationPower":      power("foxess_generation_power_watts", "Output power."),
+		"loadsPower":           power("foxess_load_power_watts", "Load power."),
+		"feedinPower":          power("foxess_feed_in_power_watts", "Power fed into the grid."),
+		"gridConsumptionPower": power("foxess_grid_consumption_power_watts", "Power consumed from the grid."),
+		"batChargePower":       power("foxess_battery_charge_power_watts", "Battery charge power."),
+		"batDischargePower":    power("foxess_battery_discharge_power_watts", "Battery discharge power."),
+		"SoC":                  {Name: "foxess_battery_soc_ratio", Type: MetricTypeGauge, Unit: "ratio", Scale: percent, Help: "Battery state of charge."},
+		"batTemperature":       {Name: "foxess_battery_temperature_celsius", Type: MetricTypeGauge, Unit: "celsius", Scale: 1, Help: "Battery temperature."},
+		"ambientTemperation":   {Name: "foxess_ambient_temperature_celsius", Type: MetricTypeGauge, Unit: "celsius", Scale: 1, Help: "Ambient temperature."},
+		"invTemperation":       {Name: "foxess_inverter_temperature_celsius", Type: MetricTypeGauge, Unit: "celsius", Scale: 1, Help: "Inverter temperature."},
+		"generation":           energy("foxess_generation_joules_total", "Cumulative energy generated."),
+		"feedin":               energy("foxess_feed_in_joules_total", "Cumulative energy fed into the grid."),
+		"gridConsumption":      energy("foxess_grid_consumption_joules_total", "Cumulative energy consumed from the grid."),
+		"chargeEnergyToTal":    energy("foxess_battery_charge_joules_total", "Cumulative energy charged into the battery."),
+		"dischargeEnergyToTal": energy("foxess_battery_discharge_joules_total", "Cumulative energy discharged from the battery."),
+		"loads":                energy("foxess_load_joules_total", "Cumulative energy consumed by loads."),
+	}
+}
+
+// power maps a variable FoxESS reports in kW to a gauge in watts.
+func power(name, help string) Mapping {
+	return Mapping{Name: name, Type: MetricTypeGauge, Unit: "watts", Source: "kW", Scale: kiloWatt, Help: help}
+}
+
+// energy maps a cumulative variable FoxESS reports in kWh to a counter in joules.
+func energy(name, help string) Mapping {
+	return Mapping{Name: name, Type: MetricTypeCounter, Unit: "joules", Source: "kWh", Scale: kiloWattHour, Help: help}
+}
+
+// LoadMappings reads mappings from a YAML (or JSON) file and applies them over the defaults. A mapping without a
+// name removes the default for that variable.
+func LoadMappings(fileName string) (Mappings, error) {
+	mappings := DefaultMappings()
+	if fileName == "" {
+		return mappings, nil
+	}
+
+	contents, err := util.FromFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mappings: %w", err)
+	}
+
+	overrides := Mappings{}
+	if err := yaml.Unmarshal(contents, &overrides); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse '%s': %w", ErrInvalidMapping, fileName, err)
+	}
+
+	for variable, mapping := range overrides {
+		if mapping.Name == "" {
+			delete(mappings, variable)
+		} else {
+			mappings[variable] = mapping
+		}
+	}
+
+	return mappings, mappings.Validate()
+}
+
+// Validate checks every mapping, filling in the default type and scale where they have been omitted.
+func (m Mappings) Validate() error {
+	names := make(map[string]string, len(m))
+	registry := builtinRegistry()
+
+	for variable, mapping := range m {
+		if !metricNamePattern.MatchString(mapping.Name) {
+			return fmt.Errorf("%w: '%s' is not a valid metric name for %s", ErrInvalidMapping, mapping.Name, variable)
+		}
+
+		if isReserved(registry, mapping.Name) {
+			return fmt.Errorf("%w: '%s' is already used by the exporter, so cannot be used for %s", ErrInvalidMapping, mapping.Name, variable)
+		}
+
+		if other, ok := names[mapping.Name]; ok {
+			return fmt.Errorf("%w: %s and %s are both mapped to '%s'", ErrInvalidMapping, other, variable, mapping.Name)
+		}
+
+		names[mapping.Name] = variable
+
+		switch mapping.Type {
+		case "":
+			mapping.Type = MetricTypeGauge
+		case MetricTypeGauge, MetricTypeCounter:
+		default:
+			return fmt.Errorf("%w: unsupported type '%s' for %s", ErrInvalidMapping, mapping.Type, variable)
+		}
+
+		if mapping.Scale == 0 {
+			mapping.Scale = 1
+		}
+
+		m[variable] = mapping
+	}
+
+	return nil
+}
+
+// builtinRegistry registers every metric the exporter exports itself, whatever its options, but no mappings.
+func builtinRegistry() *prometheus.Registry {
+	metrics := NewMetrics()
+	metrics.Registry.MustRegister(NewAPIQuota(), NewIntervals(0, 0, 0, false))
+	metrics.FetchOnScrape(NewOnScrape(nil, nil, nil, time.Time{}))
+
+	return metrics.Registry
+}
+
+// isReserved reports whether the exporter already registers a metric of the given name, or one from which a
+// histogram or summary would derive it. A descriptor of the name is registered to find out, as the registry rejects one
+// that clashes with those already registered, and then removed.
+func isReserved(registry *prometheus.Registry, name string) bool {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	names := []string{name}
+
+	for _, suffix := range derivedSuffixes {
+		if base, ok := strings.CutSuffix(name, suffix); ok {
+			names = append(names, base)
+		}
+	}
+
+	for _, name := range names {
+		probe := &probe{desc: prometheus.NewDesc(name, "", nil, nil)}
+		if err := registry.Register(probe); err != nil {
+			return true
+		}
+
+		registry.Unregister(probe)
+	}
+
+	return false
+}
+
+// probe is a collector of a single descriptor, which is never collected.
+type probe struct {
+	desc *prometheus.Desc
+}
+
+func (p *probe) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p *probe) Collect(chan<- prometheus.Metric) {}
+
+func (m *Mapping) help(variable string) string {
+	help := m.Help
+	if help == "" {
+		help = "FoxESS variable " + variable + "."
+	}
+
+	if m.Unit != "" {
+		help += " Measured in " + m.Unit + "."
+	}
+
+	return help
+}
+
+// scale returns the factor to apply to a value FoxESS reported in the given unit, or false if it cannot be converted.
+func (m *Mapping) scale(unit string) (float64, bool) {
+	if m.Source == "" || unit == m.Source {
+		return m.Scale, true
+	}
+
+	for _, family := range unitFamilies {
+		from, ok := family[unit]
+		if to, expected := family[m.Source]; ok && expected {
+			return m.Scale * from / to, true
+		}
+	}
+
+	return 0, false
+}
+
+func (m *Mapping) valueType() prometheus.ValueType {
+	if m.Type == MetricTypeCounter {
+		return prometheus.CounterValue
+	}
+
+	return prometheus.GaugeValue
+}
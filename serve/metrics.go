@@ -1,22 +1,87 @@
 package serve
 
 import (
+	"errors"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/teh-hippo/foxess-exporter/foxess"
 	"github.com/teh-hippo/foxess-exporter/util"
 )
 
+const (
+	JobRealTime = "realtime"
+	JobStatus   = "status"
+	JobQuota    = "quota"
+
+	CodeMissing = "missing"
+	CodeRequest = "request"
+)
+
 type Metrics struct {
-	realtime        *prometheus.GaugeVec
+	realtime        *realTimeCollector
 	status          *prometheus.GaugeVec
+	states          *deviceStateCollector
+	stations        *stationCollector
+	derived         *derivedCollector
+	energy          *energyCollector
+	pollErrors      *prometheus.CounterVec
+	lastSuccess     *prometheus.GaugeVec
+	requests        *requestMetrics
 	lastUpdatedTime map[string]time.Time
+	devices         map[string]bool
+	listed          []foxess.Device
+	mutex           sync.RWMutex
 	Registry        *prometheus.Registry
 }
 
-func NewMetrics() *Metrics {
+type Option func(*options)
+
+type options struct {
+	mappings   Mappings
+	generic    bool
+	timestamps bool
+	now        func() time.Time
+}
+
+// WithMappings exports each mapped variable as its own metric.
+func WithMappings(mappings Mappings) Option {
+	return func(o *options) {
+		o.mappings = mappings
+	}
+}
+
+// WithoutGenericMetric stops variables being exported through foxess_realtime_data.
+func WithoutGenericMetric() Option {
+	return func(o *options) {
+		o.generic = false
+	}
+}
+
+// WithDataTimestamps exports real-time samples with the time FoxESS recorded them, rather than the time of the scrape.
+func WithDataTimestamps() Option {
+	return func(o *options) {
+		o.timestamps = true
+	}
+}
+
+// WithClock replaces the source of the current time.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+func NewMetrics(opts ...Option) *Metrics {
+	settings := &options{mappings: nil, generic: true, timestamps: false, now: time.Now}
+	for _, opt := range opts {
+		opt(settings)
+	}
+
 	metrics := &Metrics{
 		status: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace:   "",
@@ -25,41 +90,226 @@ func NewMetrics() *Metrics {
 			Help:        "Status of the inverter.",
 			ConstLabels: nil,
 		}, []string{"inverter"}),
-		realtime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		states:   newDeviceStateCollector(settings),
+		realtime: newRealTimeCollector(settings),
+		derived:  newDerivedCollector(settings),
+		energy:   newEnergyCollector(),
+		pollErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace:   "",
 			Subsystem:   "",
-			Name:        "foxess_realtime_data",
-			Help:        "Data from the FoxESS platform.",
-			ConstLabels: prometheus.Labels{},
-		}, []string{"inverter", "variable"}),
+			Name:        "foxess_poll_errors_total",
+			Help:        "Number of failures retrieving data for an inverter.",
+			ConstLabels: nil,
+		}, []string{"job", "inverter", "code"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "foxess_last_successful_poll_timestamp_seconds",
+			Help:        "Time data was last successfully retrieved for an inverter.",
+			ConstLabels: nil,
+		}, []string{"job", "inverter"}),
+		stations:        nil,
+		requests:        nil,
 		lastUpdatedTime: make(map[string]time.Time),
+		devices:         make(map[string]bool),
+		listed:          nil,
+		mutex:           sync.RWMutex{},
 		Registry:        prometheus.NewRegistry(),
 	}
+	metrics.stations = newStationCollector(metrics.realtime)
+	metrics.requests = newRequestMetrics(metrics.Registry)
+	metrics.Registry.MustRegister(collectors.NewGoCollector())
+	metrics.Registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})) //nolint:exhaustruct
 	metrics.Registry.MustRegister(metrics.status)
+	metrics.Registry.MustRegister(metrics.states)
 	metrics.Registry.MustRegister(metrics.realtime)
+	metrics.Registry.MustRegister(metrics.stations)
+	metrics.Registry.MustRegister(metrics.derived)
+	metrics.Registry.MustRegister(metrics.energy)
+	metrics.Registry.MustRegister(metrics.pollErrors)
+	metrics.Registry.MustRegister(metrics.lastSuccess)
 
 	return metrics
 }
 
 func (x *Metrics) UpdateRealTime(data []foxess.RealTimeData) {
 	for _, result := range data {
-		if x.lastUpdatedTime[result.DeviceSN].Equal(result.Time.Time) {
-			continue
+		if !x.lastUpdatedTime[result.DeviceSN].Equal(result.Time.Time) {
+			log.Printf("Updating %d metric%s for %s, timestamp:%v.", len(result.Variables), util.Pluralise(len(result.Variables)), result.DeviceSN, result.Time.Time)
+			x.lastUpdatedTime[result.DeviceSN] = result.Time.Time
 		}
 
-		log.Printf("Updating %d metric%s for %s, timestamp:%v.", len(result.Variables), util.Pluralise(len(result.Variables)), result.DeviceSN, result.Time.Time)
-		x.lastUpdatedTime[result.DeviceSN] = result.Time.Time
+		// Refresh the series even when FoxESS has nothing newer, so they are not considered stale.
+		x.realtime.update(&result)
+		x.derived.update(result.DeviceSN, x.realtime.values(result.DeviceSN), result.Time.Time)
+		x.energy.update(&result)
+	}
+}
+
+// FetchOnScrape moves the collectors of real-time data behind onScrape, which refreshes the data before collecting
+// them.
+func (x *Metrics) FetchOnScrape(onScrape *OnScrape) {
+	onScrape.collectors = []prometheus.Collector{x.realtime, x.stations, x.derived, x.energy}
 
-		for _, variable := range result.Variables {
-			x.realtime.WithLabelValues(result.DeviceSN, variable.Variable).Set(variable.Value.Number)
-		}
+	for _, collector := range onScrape.collectors {
+		x.Registry.Unregister(collector)
+	}
+
+	x.Registry.MustRegister(onScrape)
+}
+
+// DataTime returns when FoxESS recorded the inverter's latest real-time data, or zero if none has been seen.
+func (x *Metrics) DataTime(inverter string) time.Time {
+	return x.realtime.dataTime(inverter)
+}
+
+// RemoveStale deletes real-time series that no poll has returned within maxAge.
+func (x *Metrics) RemoveStale(maxAge time.Duration) {
+	for _, inverter := range x.realtime.removeStale(maxAge) {
+		log.Printf("Removed stale real-time data for %s.", inverter)
+		x.derived.remove(inverter)
+		delete(x.lastUpdatedTime, inverter)
 	}
 }
 
+// UpdateStatus sets the status of each included device, and removes the series of any device that is no longer
+// listed or included.
 func (x *Metrics) UpdateStatus(devices []foxess.Device, include func(inverter string) bool) {
+	current := make(map[string]bool, len(devices))
+	included := make([]foxess.Device, 0, len(devices))
+
 	for _, device := range devices {
 		if include(device.DeviceSerialNumber) {
+			current[device.DeviceSerialNumber] = true
+			included = append(included, device)
 			x.status.WithLabelValues(device.DeviceSerialNumber).Set(float64(device.Status))
+			x.states.update(&device)
+		}
+	}
+
+	for inverter := range x.devices {
+		if !current[inverter] {
+			log.Printf("Removing status of %s, which is no longer listed.", inverter)
+			x.status.DeleteLabelValues(inverter)
+			x.states.remove(inverter)
+			x.lastSuccess.DeletePartialMatch(prometheus.Labels{"inverter": inverter})
+			x.pollErrors.DeletePartialMatch(prometheus.Labels{"inverter": inverter})
+		}
+	}
+
+	x.devices = current
+	x.stations.update(included)
+
+	x.mutex.Lock()
+	x.listed = included
+	x.mutex.Unlock()
+}
+
+// ConfigureStations replaces how variables are aggregated across the inverters of each station, and the battery
+// capacities used to weight them.
+func (x *Metrics) ConfigureStations(aggregations Aggregations, capacities map[string]float64) {
+	x.stations.configure(aggregations, capacities)
+}
+
+// ConfigureDerived replaces the expressions derived from each inverter's real-time data.
+func (x *Metrics) ConfigureDerived(derivations Derivations) {
+	x.derived.configure(derivations)
+}
+
+// ConfigureIntegration selects the power variables integrated into energy counters, and the longest gap between
+// samples that is integrated across.
+func (x *Metrics) ConfigureIntegration(variables []string, maxGap time.Duration) {
+	x.energy.configure(variables, maxGap)
+}
+
+// Snapshot captures the state to persist across restarts.
+func (x *Metrics) Snapshot() *State {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	return &State{
+		Energy:   x.energy.snapshot(),
+		RealTime: x.realtime.snapshot(),
+		Devices:  x.listed,
+		Quota:    nil,
+		Polls:    nil,
+	}
+}
+
+// Restore reinstates state persisted by a previous run, so metrics are available before the first poll. Only the
+// inverters included by the current settings are restored.
+func (x *Metrics) Restore(state *State, include func(inverter string) bool) {
+	realtime := includedInverters(state.RealTime, include)
+	x.energy.restore(includedInverters(state.Energy, include))
+	x.realtime.restore(realtime)
+
+	for inverter := range realtime {
+		values := x.realtime.values(inverter)
+		dataTime := x.realtime.dataTime(inverter)
+		x.lastUpdatedTime[inverter] = dataTime
+		x.derived.update(inverter, values, dataTime)
+	}
+
+	if state.Devices != nil {
+		x.UpdateStatus(state.Devices, include)
+	}
+}
+
+// includedInverters returns the entries of the included inverters.
+func includedInverters[V any](byInverter map[string]V, include func(inverter string) bool) map[string]V {
+	result := make(map[string]V, len(byInverter))
+
+	for inverter, value := range byInverter {
+		if include(inverter) {
+			result[inverter] = value
+		}
+	}
+
+	return result
+}
+
+// ObserveRequest records a call to the FoxESS API, for use as a foxess.RequestHook.
+func (x *Metrics) ObserveRequest(event *foxess.RequestEvent) {
+	x.requests.observe(event)
+}
+
+// RecordRealTimePoll attributes the outcome of a real-time poll to each of the requested inverters.
+func (x *Metrics) RecordRealTimePoll(inverters []string, data []foxess.RealTimeData, err error, now time.Time) {
+	received := make(map[string]bool, len(data))
+	for _, result := range data {
+		received[result.DeviceSN] = true
+	}
+
+	failures := foxess.FailedSerialNumbers(err)
+
+	for _, inverter := range inverters {
+		switch {
+		case received[inverter]:
+			x.PollSucceeded(JobRealTime, inverter, now)
+		case failures[inverter] != nil:
+			x.PollFailed(JobRealTime, inverter, ErrorCode(failures[inverter]))
+		case err != nil && len(failures) == 0:
+			x.PollFailed(JobRealTime, inverter, ErrorCode(err))
+		default:
+			x.PollFailed(JobRealTime, inverter, CodeMissing)
 		}
 	}
 }
+
+func (x *Metrics) PollSucceeded(job, inverter string, now time.Time) {
+	x.lastSuccess.WithLabelValues(job, inverter).Set(float64(now.Unix()))
+}
+
+func (x *Metrics) PollFailed(job, inverter, code string) {
+	x.pollErrors.WithLabelValues(job, inverter, code).Inc()
+}
+
+// ErrorCode is the FoxESS errno of err, or CodeRequest when the failure occurred before FoxESS could respond.
+func ErrorCode(err error) string {
+	var responseError *foxess.ResponseError
+	if errors.As(err, &responseError) {
+		return strconv.Itoa(responseError.ErrorNumber)
+	}
+
+	return CodeRequest
+}
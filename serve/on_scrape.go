@@ -0,0 +1,94 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	ScrapeFetched   = "fetched"
+	ScrapeCached    = "cached"
+	ScrapeThrottled = "throttled"
+)
+
+// OnScrape fetches real-time data as it is scraped, rather than on a schedule. Data younger than the TTL is served from
+// the cache, concurrent scrapes share a single fetch, and nothing is fetched while the quota does not permit it.
+type OnScrape struct {
+	ttl        func() time.Duration
+	permit     func() bool
+	fetch      func()
+	now        func() time.Time
+	group      singleflight.Group
+	mutex      sync.Mutex
+	fetched    time.Time
+	collectors []prometheus.Collector
+	scrapes    *prometheus.CounterVec
+}
+
+// NewOnScrape creates a collector that calls fetch when the data last fetched at the given time is older than the
+// TTL, and permit allows it.
+func NewOnScrape(ttl func() time.Duration, permit func() bool, fetch func(), fetched time.Time) *OnScrape {
+	return &OnScrape{
+		ttl:        ttl,
+		permit:     permit,
+		fetch:      fetch,
+		now:        time.Now,
+		group:      singleflight.Group{},
+		mutex:      sync.Mutex{},
+		fetched:    fetched,
+		collectors: nil,
+		scrapes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "foxess_scrapes_total",
+			Help:        "Scrapes by whether real-time data was fetched, served from the cache or throttled by the quota.",
+			ConstLabels: nil,
+		}, []string{"result"}),
+	}
+}
+
+func (x *OnScrape) Describe(ch chan<- *prometheus.Desc) {
+	x.scrapes.Describe(ch)
+
+	for _, collector := range x.collectors {
+		collector.Describe(ch)
+	}
+}
+
+// Collect refreshes the real-time data, if due, before collecting the metrics that depend on it.
+func (x *OnScrape) Collect(ch chan<- prometheus.Metric) {
+	x.scrapes.WithLabelValues(x.Refresh()).Inc()
+	x.scrapes.Collect(ch)
+
+	for _, collector := range x.collectors {
+		collector.Collect(ch)
+	}
+}
+
+// Refresh fetches the real-time data if the cache has expired, waiting for any fetch already under way, and reports
+// the outcome.
+func (x *OnScrape) Refresh() string {
+	result, _, _ := x.group.Do("realtime", func() (any, error) {
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+
+		if x.now().Sub(x.fetched) < x.ttl() {
+			return ScrapeCached, nil
+		}
+
+		if !x.permit() {
+			return ScrapeThrottled, nil
+		}
+
+		// Failures also wait out the TTL, so a FoxESS outage does not consume the quota on every scrape.
+		x.fetch()
+		x.fetched = x.now()
+
+		return ScrapeFetched, nil
+	})
+
+	return result.(string) //nolint:forcetypeassert
+}
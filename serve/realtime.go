@@ -0,0 +1,219 @@
+package serve
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+type sample struct {
+	value float64
+	unit  string
+	time  time.Time
+	seen  time.Time
+}
+
+// realTimeCollector exports the latest value of each variable, both through the generic foxess_realtime_data gauge
+// and through any metric the variable has been mapped to.
+type realTimeCollector struct {
+	mutex      sync.RWMutex
+	generic    *prometheus.Desc
+	timestamp  *prometheus.Desc
+	age        *prometheus.Desc
+	mappings   Mappings
+	descs      map[string]*prometheus.Desc
+	samples    map[string]map[string]sample
+	dataTimes  map[string]time.Time
+	unexpected map[string]bool
+	timestamps bool
+	now        func() time.Time
+}
+
+func newRealTimeCollector(settings *options) *realTimeCollector {
+	collector := &realTimeCollector{
+		mutex:      sync.RWMutex{},
+		generic:    nil,
+		timestamp:  prometheus.NewDesc("foxess_realtime_data_timestamp_seconds", "Time FoxESS recorded the latest real-time data.", []string{"inverter"}, nil),
+		age:        prometheus.NewDesc("foxess_realtime_data_age_seconds", "Age of the latest real-time data when scraped.", []string{"inverter"}, nil),
+		mappings:   settings.mappings,
+		descs:      make(map[string]*prometheus.Desc, len(settings.mappings)),
+		samples:    make(map[string]map[string]sample),
+		dataTimes:  make(map[string]time.Time),
+		unexpected: make(map[string]bool),
+		timestamps: settings.timestamps,
+		now:        settings.now,
+	}
+
+	if settings.generic {
+		collector.generic = prometheus.NewDesc("foxess_realtime_data", "Data from the FoxESS platform.", []string{"inverter", "variable"}, nil)
+	}
+
+	for variable, mapping := range settings.mappings {
+		collector.descs[variable] = prometheus.NewDesc(mapping.Name, mapping.help(variable), []string{"inverter"}, nil)
+	}
+
+	return collector
+}
+
+func (c *realTimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.timestamp
+	ch <- c.age
+
+	if c.generic != nil {
+		ch <- c.generic
+	}
+
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *realTimeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	now := c.now()
+
+	for inverter, dataTime := range c.dataTimes {
+		ch <- prometheus.MustNewConstMetric(c.timestamp, prometheus.GaugeValue, float64(dataTime.UnixMilli())/1000, inverter)
+		ch <- prometheus.MustNewConstMetric(c.age, prometheus.GaugeValue, now.Sub(dataTime).Seconds(), inverter)
+	}
+
+	for inverter, variables := range c.samples {
+		for variable, latest := range variables {
+			if c.generic != nil {
+				ch <- c.withTimestamp(latest, prometheus.MustNewConstMetric(c.generic, prometheus.GaugeValue, latest.value, inverter, variable))
+			}
+
+			if desc, ok := c.descs[variable]; ok {
+				mapping := c.mappings[variable]
+				if scale, ok := mapping.scale(latest.unit); ok {
+					ch <- c.withTimestamp(latest, prometheus.MustNewConstMetric(desc, mapping.valueType(), latest.value*scale, inverter))
+				}
+			}
+		}
+	}
+}
+
+func (c *realTimeCollector) withTimestamp(latest sample, metric prometheus.Metric) prometheus.Metric {
+	if !c.timestamps {
+		return metric
+	}
+
+	return prometheus.NewMetricWithTimestamp(latest.time, metric)
+}
+
+func (c *realTimeCollector) update(data *foxess.RealTimeData) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	c.dataTimes[data.DeviceSN] = data.Time.Time
+
+	variables, ok := c.samples[data.DeviceSN]
+	if !ok {
+		variables = make(map[string]sample, len(data.Variables))
+		c.samples[data.DeviceSN] = variables
+	}
+
+	for _, variable := range data.Variables {
+		variables[variable.Variable] = sample{value: variable.Value.Number, unit: variable.Unit, time: data.Time.Time, seen: now}
+		c.checkUnit(variable.Variable, variable.Unit)
+	}
+}
+
+// checkUnit warns, once for each, of a unit the mapping of a variable cannot convert from, which is not exported.
+func (c *realTimeCollector) checkUnit(variable, unit string) {
+	mapping, ok := c.mappings[variable]
+	if !ok || c.unexpected[variable+"/"+unit] {
+		return
+	}
+
+	if _, ok := mapping.scale(unit); !ok {
+		c.unexpected[variable+"/"+unit] = true
+		log.Printf("Warning: %s is reported in '%s' rather than '%s', so is not exported as %s", variable, unit, mapping.Source, mapping.Name)
+	}
+}
+
+// values returns the latest value of each variable of the inverter.
+func (c *realTimeCollector) values(inverter string) map[string]float64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	values := make(map[string]float64, len(c.samples[inverter]))
+	for variable, latest := range c.samples[inverter] {
+		values[variable] = latest.value
+	}
+
+	return values
+}
+
+func (c *realTimeCollector) snapshot() map[string]map[string]SampleState {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	snapshot := make(map[string]map[string]SampleState, len(c.samples))
+
+	for inverter, variables := range c.samples {
+		snapshot[inverter] = make(map[string]SampleState, len(variables))
+		for variable, latest := range variables {
+			snapshot[inverter][variable] = SampleState{Value: latest.value, Unit: latest.unit, Time: latest.time, Seen: latest.seen}
+		}
+	}
+
+	return snapshot
+}
+
+func (c *realTimeCollector) restore(snapshot map[string]map[string]SampleState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for inverter, variables := range snapshot {
+		c.samples[inverter] = make(map[string]sample, len(variables))
+
+		for variable, latest := range variables {
+			c.samples[inverter][variable] = sample{value: latest.Value, unit: latest.Unit, time: latest.Time, seen: latest.Seen}
+
+			if latest.Time.After(c.dataTimes[inverter]) {
+				c.dataTimes[inverter] = latest.Time
+			}
+		}
+	}
+}
+
+func (c *realTimeCollector) dataTime(inverter string) time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.dataTimes[inverter]
+}
+
+// removeStale deletes samples last seen more than maxAge ago, returning the inverters left without any.
+func (c *realTimeCollector) removeStale(maxAge time.Duration) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cutoff := c.now().Add(-maxAge)
+
+	var removed []string
+
+	for inverter, variables := range c.samples {
+		for variable, latest := range variables {
+			if latest.seen.Before(cutoff) {
+				delete(variables, variable)
+			}
+		}
+
+		if len(variables) == 0 {
+			delete(c.samples, inverter)
+			delete(c.dataTimes, inverter)
+
+			removed = append(removed, inverter)
+		}
+	}
+
+	return removed
+}
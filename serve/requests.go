@@ -0,0 +1,74 @@
+package serve
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+const (
+	durationBucketStart = 0.05
+	sizeBucketStart     = 256
+	bucketFactor        = 4
+	durationBuckets     = 7
+	sizeBuckets         = 8
+)
+
+// requestMetrics instruments the calls made to the FoxESS API.
+type requestMetrics struct {
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	size          *prometheus.HistogramVec
+	parseFailures *prometheus.CounterVec
+}
+
+func newRequestMetrics(registry *prometheus.Registry) *requestMetrics {
+	metrics := &requestMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "foxess_api_requests_total",
+			Help:        "Number of requests made to the FoxESS API.",
+			ConstLabels: nil,
+		}, []string{"endpoint", "outcome", "errno"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{ //nolint:exhaustruct
+			Name:    "foxess_api_request_duration_seconds",
+			Help:    "Duration of requests made to the FoxESS API.",
+			Buckets: prometheus.ExponentialBuckets(durationBucketStart, bucketFactor, durationBuckets),
+		}, []string{"endpoint"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{ //nolint:exhaustruct
+			Name:    "foxess_api_response_size_bytes",
+			Help:    "Size of responses from the FoxESS API.",
+			Buckets: prometheus.ExponentialBuckets(sizeBucketStart, bucketFactor, sizeBuckets),
+		}, []string{"endpoint"}),
+		parseFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "foxess_api_parse_failures_total",
+			Help:        "Number of FoxESS API responses that could not be parsed.",
+			ConstLabels: nil,
+		}, []string{"endpoint"}),
+	}
+	registry.MustRegister(metrics.requests, metrics.duration, metrics.size, metrics.parseFailures)
+
+	return metrics
+}
+
+func (x *requestMetrics) observe(event *foxess.RequestEvent) {
+	errno := ""
+	if event.Outcome == foxess.OutcomeSuccess || event.Outcome == foxess.OutcomeErrorResponse {
+		errno = strconv.Itoa(event.ErrorNumber)
+	}
+
+	x.requests.WithLabelValues(event.Path, event.Outcome, errno).Inc()
+	x.duration.WithLabelValues(event.Path).Observe(event.Duration.Seconds())
+
+	if event.Outcome != foxess.OutcomeRequestFailure {
+		x.size.WithLabelValues(event.Path).Observe(float64(event.ResponseSize))
+	}
+
+	if event.Outcome == foxess.OutcomeParseFailure {
+		x.parseFailures.WithLabelValues(event.Path).Inc()
+	}
+}
@@ -0,0 +1,88 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+// State is what the exporter persists across restarts.
+type State struct {
+	Energy   map[string]map[string]Integral    `json:"energy,omitempty"`
+	RealTime map[string]map[string]SampleState `json:"realtime,omitempty"`
+	Devices  []foxess.Device                   `json:"devices,omitempty"`
+	Quota    *QuotaState                       `json:"quota,omitempty"`
+	Polls    map[string]time.Time              `json:"polls,omitempty"`
+}
+
+// SampleState is the latest value of a real-time variable.
+type SampleState struct {
+	Value float64   `json:"value"`
+	Unit  string    `json:"unit,omitempty"`
+	Time  time.Time `json:"time"`
+	Seen  time.Time `json:"seen"`
+}
+
+// QuotaState is the latest API usage, along with the first usage seen since the quota last reset.
+type QuotaState struct {
+	Total          float64   `json:"total"`
+	Remaining      float64   `json:"remaining"`
+	PercentageUsed float64   `json:"percentageUsed"`
+	ObservedAt     time.Time `json:"observedAt"`
+	BaselineTime   time.Time `json:"baselineTime"`
+	BaselineUsed   float64   `json:"baselineUsed"`
+}
+
+// LoadState reads the state file, returning an empty state when it does not yet exist.
+func LoadState(fileName string) (*State, error) {
+	state := &State{Energy: nil, RealTime: nil, Devices: nil, Quota: nil, Polls: nil}
+
+	contents, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state file '%s': %w", fileName, err)
+	}
+
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file '%s': %w", fileName, err)
+	}
+
+	return state, nil
+}
+
+// Save writes the state to a temporary file which then replaces the state file, so it is never left partially
+// written.
+func (s *State) Save(fileName string) error {
+	contents, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), fileName); err != nil {
+		return fmt.Errorf("failed to replace state file '%s': %w", fileName, err)
+	}
+
+	return nil
+}
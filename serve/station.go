@@ -0,0 +1,215 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+type Aggregation string
+
+const (
+	AggregationSum      Aggregation = "sum"
+	AggregationAvg      Aggregation = "avg"
+	AggregationMin      Aggregation = "min"
+	AggregationMax      Aggregation = "max"
+	AggregationWeighted Aggregation = "weighted"
+	AggregationNone     Aggregation = "none"
+)
+
+var ErrInvalidAggregation = errors.New("invalid aggregation")
+
+// Aggregations are how each FoxESS variable is combined across the inverters of a station, keyed by variable name.
+type Aggregations map[string]Aggregation
+
+func DefaultAggregations() Aggregations {
+	return Aggregations{
+		"pvPower":              AggregationSum,
+		"gridConsumptionPower": AggregationSum,
+		"feedinPower":          AggregationSum,
+		"loadsPower":           AggregationSum,
+		"batChargePower":       AggregationSum,
+		"batDischargePower":    AggregationSum,
+		"SoC":                  AggregationWeighted,
+	}
+}
+
+// Merge returns the aggregations with the overrides applied over them.
+func (a Aggregations) Merge(overrides Aggregations) Aggregations {
+	merged := maps.Clone(a)
+	maps.Copy(merged, overrides)
+
+	return merged
+}
+
+func (a Aggregations) Validate() error {
+	for variable, aggregation := range a {
+		switch aggregation {
+		case AggregationSum, AggregationAvg, AggregationMin, AggregationMax, AggregationWeighted, AggregationNone:
+		default:
+			return fmt.Errorf("%w: unsupported aggregation '%s' for %s", ErrInvalidAggregation, aggregation, variable)
+		}
+	}
+
+	return nil
+}
+
+type station struct {
+	id   string
+	name string
+}
+
+type stationGroup struct {
+	station     station
+	aggregation Aggregation
+	values      []float64
+	weights     []float64
+}
+
+// stationCollector aggregates the latest real-time data of the inverters in each station. Weighted aggregations use
+// the battery capacity of each inverter, either as configured or derived from its residual energy and state of
+// charge.
+type stationCollector struct {
+	mutex        sync.RWMutex
+	desc         *prometheus.Desc
+	realtime     *realTimeCollector
+	stations     map[string]station
+	aggregations Aggregations
+	capacities   map[string]float64
+}
+
+func newStationCollector(realtime *realTimeCollector) *stationCollector {
+	return &stationCollector{
+		mutex: sync.RWMutex{},
+		desc: prometheus.NewDesc("foxess_station_realtime_data", "Data from the FoxESS platform, aggregated across the inverters of a station.",
+			[]string{"station_id", "station_name", "variable"}, nil),
+		realtime:     realtime,
+		stations:     make(map[string]station),
+		aggregations: DefaultAggregations(),
+		capacities:   nil,
+	}
+}
+
+func (c *stationCollector) configure(aggregations Aggregations, capacities map[string]float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.aggregations = aggregations
+	c.capacities = capacities
+}
+
+// update replaces the station of each inverter from the device list.
+func (c *stationCollector) update(devices []foxess.Device) {
+	stations := make(map[string]station, len(devices))
+
+	for _, device := range devices {
+		if device.StationID != "" {
+			stations[device.DeviceSerialNumber] = station{id: device.StationID, name: device.StationName}
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stations = stations
+}
+
+func (c *stationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *stationCollector) Collect(ch chan<- prometheus.Metric) {
+	for key, group := range c.groups() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, aggregate(group.aggregation, group.values, group.weights),
+			group.station.id, group.station.name, key[1])
+	}
+}
+
+// groups collects the values of each aggregated variable, keyed by station ID and variable.
+func (c *stationCollector) groups() map[[2]string]*stationGroup {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	c.realtime.mutex.RLock()
+	defer c.realtime.mutex.RUnlock()
+
+	groups := make(map[[2]string]*stationGroup)
+
+	for inverter, station := range c.stations {
+		variables := c.realtime.samples[inverter]
+
+		for variable, aggregation := range c.aggregations {
+			latest, ok := variables[variable]
+			if !ok || aggregation == AggregationNone {
+				continue
+			}
+
+			key := [2]string{station.id, variable}
+			if groups[key] == nil {
+				groups[key] = &stationGroup{station: station, aggregation: aggregation, values: nil, weights: nil}
+			}
+
+			groups[key].values = append(groups[key].values, latest.value)
+			groups[key].weights = append(groups[key].weights, c.capacity(inverter, variables))
+		}
+	}
+
+	return groups
+}
+
+// capacity is the configured battery capacity of the inverter, or that implied by its residual energy and state of
+// charge, or 0 when unknown.
+func (c *stationCollector) capacity(inverter string, variables map[string]sample) float64 {
+	if capacity := c.capacities[inverter]; capacity > 0 {
+		return capacity
+	}
+
+	residual, hasResidual := variables["ResidualEnergy"]
+	soc, hasSoC := variables["SoC"]
+
+	if !hasResidual || !hasSoC || soc.value <= 0 {
+		return 0
+	}
+
+	return residual.value / (soc.value * percent)
+}
+
+// aggregate combines the values, falling back to a plain average when weighted by capacities that are all unknown.
+func aggregate(aggregation Aggregation, values, weights []float64) float64 {
+	switch aggregation {
+	case AggregationMin:
+		return slices.Min(values)
+	case AggregationMax:
+		return slices.Max(values)
+	case AggregationAvg:
+		return sumOf(values) / float64(len(values))
+	case AggregationWeighted:
+		weighted, total := 0.0, 0.0
+		for i, value := range values {
+			weighted += value * weights[i]
+			total += weights[i]
+		}
+
+		if total == 0 {
+			return sumOf(values) / float64(len(values))
+		}
+
+		return weighted / total
+	default:
+		return sumOf(values)
+	}
+}
+
+func sumOf(values []float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+
+	return sum
+}
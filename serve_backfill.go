@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+const backfillChunk = 24 * time.Hour
+
+// window is a period of history to request.
+type window struct {
+	begin time.Time
+	end   time.Time
+}
+
+// backfillRequest is a gap in an inverter's history, awaiting backfill.
+type backfillRequest struct {
+	inverter  string
+	after     time.Time
+	before    time.Time
+	variables []string
+	limit     time.Duration
+}
+
+// detectGaps queues a backfill of any inverter whose latest data is more than the max gap after the data before it,
+// such as after the exporter was down. Its real-time data is held back from remote write until the backfill is queued.
+// It must be called before the metrics are updated.
+func (x *ServeCommand) detectGaps(data []foxess.RealTimeData, settings ServeOptions) {
+	if !settings.Backfill || x.remoteWrite == nil {
+		return
+	}
+
+	for _, result := range data {
+		last := x.metrics.DataTime(result.DeviceSN)
+		if last.IsZero() || result.Time.Sub(last) <= settings.MaxGap {
+			continue
+		}
+
+		variables := make([]string, len(result.Variables))
+		for i, variable := range result.Variables {
+			variables[i] = variable.Variable
+		}
+
+		x.queueBackfill(backfillRequest{
+			inverter:  result.DeviceSN,
+			after:     last,
+			before:    result.Time.Time,
+			variables: variables,
+			limit:     settings.BackfillLimit,
+		})
+	}
+}
+
+// queueBackfill holds back the inverter's real-time data and queues its backfill, unless it is already being
+// backfilled or backfilling has stopped.
+func (x *ServeCommand) queueBackfill(request backfillRequest) {
+	x.heldMutex.Lock()
+	defer x.heldMutex.Unlock()
+
+	if _, ok := x.held[request.inverter]; ok || x.backfillStopped {
+		return
+	}
+
+	if x.held == nil {
+		x.held = make(map[string][]foxess.RealTimeData)
+	}
+
+	x.held[request.inverter] = nil
+	x.backfills = append(x.backfills, request)
+
+	select {
+	case x.backfillQueued <- struct{}{}:
+	default:
+	}
+}
+
+// runBackfills backfills the queued gaps one at a time until the context is cancelled, as polls and scrapes only queue
+// them. Once cancelled, the data held back for any gaps still queued is released.
+func (x *ServeCommand) runBackfills(ctx context.Context) {
+	if x.remoteWrite == nil {
+		return
+	}
+
+	x.backfillQueued = make(chan struct{}, 1)
+
+	x.polls.Add(1)
+
+	go func() {
+		defer x.polls.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+				x.stopBackfills()
+
+				return
+			case <-x.backfillQueued:
+			}
+
+			for request, ok := x.nextBackfill(); ok; request, ok = x.nextBackfill() {
+				x.backfill(ctx, request)
+				x.release(request.inverter)
+			}
+		}
+	}()
+}
+
+// nextBackfill takes the next queued backfill, reporting false when there are none.
+func (x *ServeCommand) nextBackfill() (backfillRequest, bool) {
+	x.heldMutex.Lock()
+	defer x.heldMutex.Unlock()
+
+	if len(x.backfills) == 0 {
+		return backfillRequest{}, false //nolint:exhaustruct
+	}
+
+	request := x.backfills[0]
+	x.backfills = x.backfills[1:]
+
+	return request, true
+}
+
+// stopBackfills abandons the queued backfills, releasing the data held back for them, and stops queueing any more.
+func (x *ServeCommand) stopBackfills() {
+	x.heldMutex.Lock()
+	pending := x.backfills
+	x.backfills = nil
+	x.backfillStopped = true
+	x.heldMutex.Unlock()
+
+	for _, request := range pending {
+		x.release(request.inverter)
+	}
+}
+
+// holdBack returns the data of inverters that are not being backfilled, keeping the rest until they are released.
+func (x *ServeCommand) holdBack(data []foxess.RealTimeData) []foxess.RealTimeData {
+	x.heldMutex.Lock()
+	defer x.heldMutex.Unlock()
+
+	result := make([]foxess.RealTimeData, 0, len(data))
+
+	for _, item := range data {
+		if held, ok := x.held[item.DeviceSN]; ok {
+			x.held[item.DeviceSN] = append(held, item)
+		} else {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// release writes the data held back from the inverter, once its backfill is queued ahead of it.
+func (x *ServeCommand) release(inverter string) {
+	x.heldMutex.Lock()
+	defer x.heldMutex.Unlock()
+
+	if err := x.remoteWrite.Write(x.held[inverter]); err != nil {
+		log.Printf("Unable to push real-time data: %v", err)
+	}
+
+	delete(x.held, inverter)
+}
+
+// backfill pushes the history of a gap via remote write, a day at a time, as far as the quota allows without starving
+// the regular polls. When it does not allow it all, the most recent history is preferred. It stops early when the
+// context is cancelled.
+func (x *ServeCommand) backfill(ctx context.Context, request backfillRequest) {
+	inverter := request.inverter
+
+	windows := backfillWindows(request.after, request.before, request.limit)
+	if budget := max(x.backfillBudget(), 0); budget < len(windows) {
+		log.Printf("The API quota only permits backfilling %d of %d days for %s", budget, len(windows), inverter)
+		windows = windows[len(windows)-budget:]
+	}
+
+	if len(windows) == 0 {
+		return
+	}
+
+	log.Printf("Backfilling %s from %v to %v", inverter, windows[0].begin, request.before)
+
+	for _, window := range windows {
+		if ctx.Err() != nil {
+			log.Printf("Stopped backfilling %s at %v", inverter, window.begin)
+
+			return
+		}
+
+		histories, err := x.config.GetVariableHistory(inverter, window.begin, window.end, request.variables)
+		if err != nil {
+			log.Printf("Unable to backfill %s: %v", inverter, err)
+
+			return
+		}
+
+		if err := x.remoteWrite.WriteHistory(between(histories, request.after, request.before)); err != nil {
+			log.Printf("Unable to backfill %s: %v", inverter, err)
+
+			return
+		}
+	}
+}
+
+// backfillBudget is how many calls remain once the regular polls until the quota resets are accounted for.
+func (x *ServeCommand) backfillBudget() int {
+	usage, reset := x.apiQuota.Current()
+	if usage == nil {
+		return 0
+	}
+
+	untilReset := time.Until(reset)
+	demand := untilReset/x.intervals.RealTime()*time.Duration(x.realTimeBatches()) + untilReset/x.intervals.Status() +
+		untilReset/serve.QuotaInterval
+
+	return int(usage.Remaining) - int(demand)
+}
+
+// backfillWindows divides the gap, up to limit before its end, into days.
+func backfillWindows(after, before time.Time, limit time.Duration) []window {
+	var windows []window
+
+	begin := after
+	if earliest := before.Add(-limit); earliest.After(begin) {
+		begin = earliest
+	}
+
+	for ; begin.Before(before); begin = begin.Add(backfillChunk) {
+		end := begin.Add(backfillChunk)
+		if end.After(before) {
+			end = before
+		}
+
+		windows = append(windows, window{begin: begin, end: end})
+	}
+
+	return windows
+}
+
+// between keeps the data points strictly inside the gap, which the samples either side of it already cover.
+func between(histories []foxess.InverterHistory, after, before time.Time) []foxess.InverterHistory {
+	result := make([]foxess.InverterHistory, len(histories))
+
+	for i, history := range histories {
+		result[i] = foxess.InverterHistory{DeviceSN: history.DeviceSN, Variables: make([]foxess.VariableHistory, len(history.Variables))}
+
+		for j, variable := range history.Variables {
+			result[i].Variables[j] = variable
+			result[i].Variables[j].DataPoints = nil
+
+			for _, point := range variable.DataPoints {
+				if point.Time.After(after) && point.Time.Before(before) {
+					result[i].Variables[j].DataPoints = append(result[i].Variables[j].DataPoints, point)
+				}
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/serve"
+	"github.com/teh-hippo/foxess-exporter/sink"
+)
+
+func TestBackfillWindowsAreDaysUpToTheLimit(t *testing.T) {
+	t.Parallel()
+
+	before := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	windows := backfillWindows(before.Add(-time.Hour), before, 72*time.Hour)
+	assert.Equal(t, []window{{begin: before.Add(-time.Hour), end: before}}, windows)
+
+	windows = backfillWindows(before.Add(-10*24*time.Hour), before, 36*time.Hour)
+	assert.Equal(t, []window{
+		{begin: before.Add(-36 * time.Hour), end: before.Add(-12 * time.Hour)},
+		{begin: before.Add(-12 * time.Hour), end: before},
+	}, windows)
+}
+
+func TestServeBackfillsGapsFromHistory(t *testing.T) {
+	t.Parallel()
+
+	written := make(chan *prompb.WriteRequest, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		decoded, err := snappy.Decode(nil, body)
+		assert.NoError(t, err)
+
+		var request prompb.WriteRequest
+		assert.NoError(t, proto.Unmarshal(decoded, &request))
+
+		written <- &request
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(receiver.Close)
+
+	foxESS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/op/v0/user/getAccessCount":
+			_, _ = w.Write([]byte(`{"errno":0,"result":{"total":"1440","remaining":"1000"}}`))
+		case "/op/v0/device/list":
+			_, _ = w.Write([]byte(`{"errno":0,"result":{"total":1,"data":[{"deviceSN":"SN1","status":1}]}}`))
+		case "/op/v1/device/real/query":
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"deviceSN":"SN1","time":"2024-01-01 00:00:00 CST+0800","datas":[{"variable":"pvPower","value":3}]}]}`))
+		case "/op/v0/device/history/query":
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"deviceSN":"SN1","datas":[{"variable":"pvPower","unit":"kW","name":"PVPower","data":[` +
+				`{"time":"2023-12-31 22:00:00 CST+0800","value":1},` +
+				`{"time":"2023-12-31 23:00:00 CST+0800","value":2},` +
+				`{"time":"2024-01-01 00:00:00 CST+0800","value":3}]}]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(foxESS.Close)
+
+	last := time.Date(2023, 12, 31, 14, 0, 0, 0, time.UTC)
+	state := &serve.State{
+		Energy:   nil,
+		RealTime: map[string]map[string]serve.SampleState{"SN1": {"pvPower": {Value: 1, Unit: "kW", Time: last, Seen: last}}},
+		Devices:  nil,
+		Quota:    nil,
+		Polls:    nil,
+	}
+
+	subject := buildSubject()
+	subject.config.Client = redirect(foxESS)
+	subject.StateFile = filepath.Join(t.TempDir(), "state.json")
+	subject.Backfill = true
+	subject.BackfillLimit = 72 * time.Hour
+	subject.RemoteWrite = sink.RemoteWriteConfig{ //nolint:exhaustruct
+		URL:         receiver.URL,
+		BatchSize:   100,
+		HTTPConfig:  sink.HTTPConfig{Timeout: time.Second},                                                  //nolint:exhaustruct
+		QueueConfig: sink.QueueConfig{QueueSize: 10, MinBackoff: time.Millisecond, MaxBackoff: time.Second}, //nolint:exhaustruct
+	}
+	require.NoError(t, state.Save(subject.StateFile))
+
+	cancel, done := serveInBackground(t, subject)
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	// The history in the gap is delivered ahead of the live sample, which the receiver would otherwise reject it behind.
+	var samples []prompb.Sample
+
+	for len(samples) < 2 {
+		select {
+		case request := <-written:
+			for _, series := range request.Timeseries {
+				samples = append(samples, series.Samples...)
+			}
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "the gap was not backfilled")
+		}
+	}
+
+	assert.Equal(t, []prompb.Sample{
+		{Value: 2, Timestamp: last.Add(time.Hour).UnixMilli()},     //nolint:exhaustruct
+		{Value: 3, Timestamp: last.Add(2 * time.Hour).UnixMilli()}, //nolint:exhaustruct
+	}, samples)
+}
+
+func TestShutdownStopsBackfilling(t *testing.T) {
+	t.Parallel()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(receiver.Close)
+
+	var windows atomic.Int32
+
+	requested := make(chan struct{}, 1)
+	foxESS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/op/v0/user/getAccessCount":
+			_, _ = w.Write([]byte(`{"errno":0,"result":{"total":"1440","remaining":"1440"}}`))
+		case "/op/v0/device/list":
+			_, _ = w.Write([]byte(`{"errno":0,"result":{"total":1,"data":[{"deviceSN":"SN1","status":1}]}}`))
+		case "/op/v1/device/real/query":
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"deviceSN":"SN1","time":"2024-01-01 00:00:00 CST+0800","datas":[{"variable":"pvPower","value":3}]}]}`))
+		case "/op/v0/device/history/query":
+			windows.Add(1)
+
+			select {
+			case requested <- struct{}{}:
+			default:
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"deviceSN":"SN1","datas":[{"variable":"pvPower","unit":"kW","name":"PVPower","data":[]}]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(foxESS.Close)
+
+	last := time.Date(2023, 12, 21, 16, 0, 0, 0, time.UTC)
+	state := &serve.State{
+		Energy:   nil,
+		RealTime: map[string]map[string]serve.SampleState{"SN1": {"pvPower": {Value: 1, Unit: "kW", Time: last, Seen: last}}},
+		Devices:  nil,
+		Quota:    nil,
+		Polls:    nil,
+	}
+
+	subject := buildSubject()
+	subject.config.Client = redirect(foxESS)
+	subject.StateFile = filepath.Join(t.TempDir(), "state.json")
+	subject.Backfill = true
+	subject.BackfillLimit = 10 * 24 * time.Hour
+	subject.RemoteWrite = sink.RemoteWriteConfig{ //nolint:exhaustruct
+		URL:         receiver.URL,
+		BatchSize:   100,
+		HTTPConfig:  sink.HTTPConfig{Timeout: time.Second},                                                  //nolint:exhaustruct
+		QueueConfig: sink.QueueConfig{QueueSize: 10, MinBackoff: time.Millisecond, MaxBackoff: time.Second}, //nolint:exhaustruct
+	}
+	require.NoError(t, state.Save(subject.StateFile))
+
+	cancel, done := serveInBackground(t, subject)
+
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the gap was not backfilled")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "serve did not shut down")
+	}
+
+	assert.Less(t, windows.Load(), int32(10), "the remaining days are abandoned on shutdown")
+}
@@ -1,32 +1,51 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/teh-hippo/foxess-exporter/foxess"
 	"github.com/teh-hippo/foxess-exporter/serve"
-	"github.com/teh-hippo/foxess-exporter/util"
+	"github.com/teh-hippo/foxess-exporter/sink"
 )
 
 const Ten = 10
 
+var ErrShutdownTimeout = errors.New("shutdown timed out")
+
 type ServeCommand struct {
-	Port             int             `short:"p" long:"port"              description:"Port to listen on"                  env:"PORT"               required:"true" default:"2112"`
-	Inverters        map[string]bool `short:"i" long:"inverter"          description:"Inverter serial numbers"            env:"INVERTERS"          env-delim:""`
-	Variables        []string        `short:"V" long:"variable"          description:"Variables to retrieve"              env:"VARIABLES"          env-delim:""`
-	RealTimeInterval time.Duration   `short:"R" long:"realtime-interval" description:"Update frequency of real-time data" env:"REAL_TIME_INTERVAL" required:"true" default:"3m"`
-	StatusInterval   time.Duration   `short:"S" long:"status-interval"   description:"Update frequency of devices status" env:"STATUS_INTERVAL"    required:"true" default:"15m"`
-	Verbose          bool            `short:"v" long:"verbose"           description:"Enable verbose logging"             env:"VERBOSE"`
-	deviceCache      *serve.DeviceCache
-	apiQuota         *serve.APIQuota
-	metrics          *serve.Metrics
-	config           *foxess.Config
+	ConfigFile string `short:"c" long:"config" description:"YAML file of serve settings, reloaded on SIGHUP or change" env:"CONFIG_FILE"`
+	ServeOptions
+	deviceCache     *serve.DeviceCache
+	apiQuota        *serve.APIQuota
+	intervals       *serve.Intervals
+	health          *serve.Health
+	metrics         *serve.Metrics
+	config          *foxess.Config
+	mutex           sync.RWMutex
+	flagOptions     ServeOptions
+	polls           sync.WaitGroup
+	lastPolled      sync.Map
+	stateMutex      sync.Mutex
+	shutdownHooks   []func(ctx context.Context) error
+	sinks           []sink.Sink
+	remoteWrite     *sink.RemoteWrite
+	held            map[string][]foxess.RealTimeData
+	backfills       []backfillRequest
+	backfillQueued  chan struct{}
+	backfillStopped bool
+	heldMutex       sync.Mutex
 }
 
 func (x *ServeCommand) Register(parser *flags.Parser, config *foxess.Config) {
@@ -37,56 +56,295 @@ func (x *ServeCommand) Register(parser *flags.Parser, config *foxess.Config) {
 	x.config = config
 	x.deviceCache = serve.NewDeviceCache()
 	x.apiQuota = serve.NewAPIQuota()
-	x.metrics = serve.NewMetrics()
 }
 
-func (x *ServeCommand) validateIntervals() error {
-	const oneDay time.Duration = 24 * time.Hour
-	x.RealTimeInterval = util.Clamp(x.RealTimeInterval, time.Minute, oneDay)
-	x.StatusInterval = util.Clamp(x.StatusInterval, time.Minute, oneDay)
+func (x *ServeCommand) RequiresAPIKey() bool {
+	return true
+}
+
+func (x *ServeCommand) prepare() error {
+	mappings, err := serve.LoadMappings(x.MappingFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
+
+	derivations, err := serve.ParseDerivations(x.Derived)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
 
-	apiCallsPerDay := float64(oneDay.Minutes())
-	realTimeCalls := oneDay / x.RealTimeInterval
-	apiCallsPerDay -= float64(realTimeCalls)
-	statusCalls := oneDay / x.StatusInterval
-	apiCallsPerDay -= float64(statusCalls)
+	options := []serve.Option{serve.WithMappings(mappings)}
+	if x.NoGenericMetric {
+		options = append(options, serve.WithoutGenericMetric())
+	}
 
-	if apiCallsPerDay < 0 {
-		return fmt.Errorf("%w: %s", ErrInvalidArgument, "current intervals would result in API usage exceeding the maximum daily allowance")
+	if x.DataTimestamps {
+		options = append(options, serve.WithDataTimestamps())
+	}
+
+	location, err := time.LoadLocation(x.QuotaResetZone)
+	if err != nil {
+		return fmt.Errorf("%w: unknown quota reset zone '%s': %w", ErrInvalidArgument, x.QuotaResetZone, err)
+	}
+
+	x.apiQuota.SetResetLocation(location)
+
+	if !x.Adaptive {
+		if err := x.validateIntervals(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	x.intervals = serve.NewIntervals(x.RealTimeInterval, x.StatusInterval, x.MinInterval, x.Adaptive)
+	x.health = serve.NewHealth(x.deviceCache, x.apiQuota, func() time.Duration {
+		return time.Duration(x.settings().ReadyIntervals) * x.intervals.RealTime()
+	})
+	x.metrics = serve.NewMetrics(options...)
+	x.metrics.Registry.MustRegister(x.apiQuota, x.intervals)
+	x.metrics.ConfigureStations(x.aggregations(), x.batteryCapacities())
+	x.metrics.ConfigureDerived(derivations)
+	x.metrics.ConfigureIntegration(x.Integrate, x.MaxGap)
+	x.config.AddRequestHook(x.metrics.ObserveRequest)
+
+	if err := x.openSinks(mappings); err != nil {
+		return err
+	}
+
+	if err := x.restoreState(); err != nil {
+		return err
+	}
+
+	if x.OnScrape {
+		var fetched time.Time
+		if last, ok := x.lastPolled.Load(serve.JobRealTime); ok {
+			fetched = last.(time.Time) //nolint:forcetypeassert
+		}
+
+		x.metrics.FetchOnScrape(serve.NewOnScrape(x.intervals.RealTime, x.scrapePermitted, x.fetchOnScrape, fetched))
+		x.health.FetchOnScrape()
 	}
 
 	return nil
 }
 
-func (x *ServeCommand) Execute(_ []string) error {
-	if len(x.Inverters) > 0 {
-		ids := make([]string, 0, len(x.Inverters))
-		for deviceID := range x.Inverters {
-			ids = append(ids, deviceID)
+// restoreState reinstates the state persisted by a previous run, so metrics are served and polls resume on schedule
+// straight away, and saves it again on shutdown.
+func (x *ServeCommand) restoreState() error {
+	if x.StateFile == "" {
+		return nil
+	}
+
+	state, err := serve.LoadState(x.StateFile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	x.metrics.Restore(state, x.include)
+
+	if x.apiQuota.Restore(state.Quota, now) {
+		x.lastPolled.Store(serve.JobQuota, state.Polls[serve.JobQuota])
+	}
+
+	x.writeDevices(state.Devices, x.include)
+
+	if len(x.Inverters) == 0 && len(state.Devices) > 0 {
+		ids := make([]string, 0, len(state.Devices))
+		for _, device := range state.Devices {
+			if x.include(device.DeviceSerialNumber) {
+				ids = append(ids, device.DeviceSerialNumber)
+			}
 		}
 
 		x.deviceCache.Set(ids)
 	}
 
-	x.run(Ten*time.Minute, false, x.updateAPIQuota)
-	x.run(x.StatusInterval, true, x.updateDeviceStatus)
-	x.run(x.RealTimeInterval, true, x.updateRealTimeMetrics)
+	for _, job := range []string{serve.JobStatus, serve.JobRealTime} {
+		if last, ok := state.Polls[job]; ok {
+			x.lastPolled.Store(job, last)
+		}
+	}
+
+	if last, ok := state.Polls[serve.JobRealTime]; ok {
+		x.health.RealTimePolled(last)
+	}
+
+	x.onShutdown(func(context.Context) error {
+		return x.saveState()
+	})
+
+	return nil
+}
+
+func (x *ServeCommand) validateIntervals() error {
+	return x.ServeOptions.validateIntervals(x.dailyAllowance(), x.deviceCache.Peek())
+}
+
+// dailyAllowance is the actual API quota once known, or the FoxESS default until then.
+func (x *ServeCommand) dailyAllowance() float64 {
+	if usage, _ := x.apiQuota.Current(); usage != nil {
+		return usage.Total
+	}
+
+	return serve.DefaultDailyQuota
+}
+
+// realTimeBatches is the number of API calls each real-time poll makes.
+func (x *ServeCommand) realTimeBatches() int {
+	settings := x.settings()
+
+	return settings.realTimeBatches(x.deviceCache.Peek())
+}
+
+func (x *ServeCommand) Execute(_ []string) error {
+	if err := x.loadConfig(); err != nil {
+		return err
+	}
+
+	if err := x.prepare(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return x.serve(ctx)
+}
+
+// serve polls FoxESS and serves metrics until the context is cancelled, then shuts down gracefully.
+func (x *ServeCommand) serve(ctx context.Context) error {
+	if ids := x.filteredInverters(); len(ids) > 0 {
+		x.deviceCache.Set(ids)
+	}
+
+	x.watchConfig(ctx)
+	x.runBackfills(ctx)
+
+	x.run(ctx, serve.JobQuota, func() time.Duration { return serve.QuotaInterval }, false, x.updateAPIQuota)
+	x.run(ctx, serve.JobStatus, x.intervals.Status, true, x.updateDeviceStatus)
+
+	if !x.OnScrape {
+		x.run(ctx, serve.JobRealTime, x.intervals.RealTime, true, x.updateRealTimeMetrics)
+	}
 
-	http.Handle("/metrics", promhttp.HandlerFor(x.metrics.Registry, promhttp.HandlerOpts{ //nolint:exhaustruct
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(x.metrics.Registry, promhttp.HandlerOpts{ //nolint:exhaustruct
 		ErrorLog: log.Default(),
 	}))
-	http.Handle("/favicon.ico", http.RedirectHandler("https://www.foxesscloud.com/favicon.ico", http.StatusMovedPermanently))
+	mux.HandleFunc("/healthz", x.health.Liveness)
+	mux.HandleFunc("/readyz", x.health.Readiness)
+	mux.Handle("/favicon.ico", http.RedirectHandler("https://www.foxesscloud.com/favicon.ico", http.StatusMovedPermanently))
 
-	server := &http.Server{Addr: ":" + strconv.Itoa(x.Port), ReadHeaderTimeout: Ten * time.Second} //nolint:exhaustruct
+	server := &http.Server{Addr: ":" + strconv.Itoa(x.Port), Handler: mux, ReadHeaderTimeout: Ten * time.Second} //nolint:exhaustruct
+	serverErr := make(chan error, 1)
 
-	err := server.ListenAndServe()
-	if err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	var err error
+
+	select {
+	case err = <-serverErr:
+		err = fmt.Errorf("failed to start server: %w", err)
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+	}
+
+	return errors.Join(err, x.shutdown(server))
+}
+
+// shutdown stops the HTTP server, waits for in-flight polls to complete and then runs the shutdown hooks, all within
+// the shutdown timeout.
+func (x *ServeCommand) shutdown(server *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), x.ShutdownTimeout)
+	defer cancel()
+
+	// Release any polls still waiting for the first device list or quota.
+	x.deviceCache.Close()
+	x.apiQuota.Close()
+
+	var errs []error
+
+	if err := server.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down server: %w", err))
+	}
+
+	polled := make(chan struct{})
+
+	go func() {
+		x.polls.Wait()
+		close(polled)
+	}()
+
+	select {
+	case <-polled:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("%w: waiting for in-flight polls", ErrShutdownTimeout))
+	}
+
+	for _, hook := range x.shutdownHooks {
+		if err := hook(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (x *ServeCommand) saveState() error {
+	if x.StateFile == "" {
+		return nil
+	}
+
+	x.stateMutex.Lock()
+	defer x.stateMutex.Unlock()
+
+	state := x.metrics.Snapshot()
+	state.Quota = x.apiQuota.Snapshot()
+	state.Polls = make(map[string]time.Time)
+
+	x.lastPolled.Range(func(job, last any) bool {
+		state.Polls[job.(string)] = last.(time.Time) //nolint:forcetypeassert
+
+		return true
+	})
+
+	if err := state.Save(x.StateFile); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
 	}
 
 	return nil
 }
 
+// polled records when the job last ran, saving the state.
+func (x *ServeCommand) polled(job string) {
+	x.lastPolled.Store(job, time.Now())
+
+	if err := x.saveState(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// fetchOnScrape polls real-time data for a scrape, in place of the real-time job.
+func (x *ServeCommand) fetchOnScrape() {
+	x.updateRealTimeMetrics()
+	x.polled(serve.JobRealTime)
+}
+
+// scrapePermitted reports whether a scrape may fetch real-time data, which needs the devices and some quota remaining,
+// without waiting for either.
+func (x *ServeCommand) scrapePermitted() bool {
+	usage, _ := x.apiQuota.Current()
+
+	return usage != nil && usage.Remaining > 0 && x.deviceCache.Peek() != nil
+}
+
+// onShutdown registers a hook to flush pending work once polling has stopped.
+func (x *ServeCommand) onShutdown(hook func(ctx context.Context) error) {
+	x.shutdownHooks = append(x.shutdownHooks, hook)
+}
+
 func (x *ServeCommand) updateAPIQuota() {
 	apiUsage, err := x.config.GetAPIUsage()
 	if err != nil {
@@ -94,8 +352,22 @@ func (x *ServeCommand) updateAPIQuota() {
 	} else {
 		x.verbose("Updating API usage")
 		x.apiQuota.Set(apiUsage)
+		x.writeQuota(apiUsage)
 		log.Printf("Usage: %.0f/%.0f (%.2f%%)\n", apiUsage.Total-apiUsage.Remaining, apiUsage.Total, apiUsage.PercentageUsed)
+
+		x.adapt()
+	}
+}
+
+// adapt recalculates the intervals from the remaining API quota, when enabled and known.
+func (x *ServeCommand) adapt() {
+	usage, reset := x.apiQuota.Current()
+	if !x.settings().Adaptive || usage == nil {
+		return
 	}
+
+	x.intervals.Recalculate(usage.Remaining, time.Until(reset), x.realTimeBatches())
+	x.verbose("Polling real-time data every %v and status every %v", x.intervals.RealTime(), x.intervals.Status())
 }
 
 func (x *ServeCommand) updateDeviceStatus() {
@@ -105,14 +377,30 @@ func (x *ServeCommand) updateDeviceStatus() {
 
 	if err != nil {
 		log.Printf("Unable to update device list: %v", err)
+
+		for _, inverter := range x.deviceCache.Peek() {
+			x.metrics.PollFailed(serve.JobStatus, inverter, serve.ErrorCode(err))
+		}
 	} else {
-		x.metrics.UpdateStatus(devices, x.Include)
-		hasFilter := len(x.Inverters) > 0
+		settings := x.settings()
+		x.metrics.UpdateStatus(devices, settings.include)
+		x.writeDevices(devices, settings.include)
+
+		now := time.Now()
+		for _, device := range devices {
+			if settings.include(device.DeviceSerialNumber) {
+				x.metrics.PollSucceeded(serve.JobStatus, device.DeviceSerialNumber, now)
+			}
+		}
+
+		hasFilter := len(settings.Inverters) > 0
 
 		if !hasFilter {
-			ids := make([]string, len(devices))
-			for i, device := range devices {
-				ids[i] = device.DeviceSerialNumber
+			ids := make([]string, 0, len(devices))
+			for _, device := range devices {
+				if settings.include(device.DeviceSerialNumber) {
+					ids = append(ids, device.DeviceSerialNumber)
+				}
 			}
 
 			x.deviceCache.Set(ids)
@@ -123,32 +411,86 @@ func (x *ServeCommand) updateDeviceStatus() {
 func (x *ServeCommand) updateRealTimeMetrics() {
 	x.verbose("Retrieving latest real-time data")
 
-	data, err := x.config.GetRealTimeData(x.deviceCache.Get(), x.Variables)
+	settings := x.settings()
+
+	var (
+		inverters []string
+		data      []foxess.RealTimeData
+		errs      []error
+	)
+
+	for _, query := range settings.realTimeQueries(x.deviceCache.Get()) {
+		result, err := x.config.GetRealTimeData(query.inverters, query.variables)
+		inverters = append(inverters, query.inverters...)
+		data = append(data, result...)
+		errs = append(errs, err)
+	}
+
+	err := errors.Join(errs...)
 	if err != nil {
-		log.Printf("Unable to retrieve latest real-time data: %v", err)
+		log.Printf("Unable to retrieve all of the latest real-time data (%d succeeded): %v", len(data), err)
 	}
 
+	now := time.Now()
+	x.detectGaps(data, settings)
 	x.metrics.UpdateRealTime(data)
+	x.metrics.RecordRealTimePoll(inverters, data, err, now)
+
+	if err == nil || len(data) > 0 {
+		x.health.RealTimePolled(now)
+	}
+
+	x.writeSinks(data)
+
+	if settings.StaleIntervals > 0 {
+		x.metrics.RemoveStale(time.Duration(settings.StaleIntervals) * x.intervals.RealTime())
+	}
 }
 
-func (x *ServeCommand) run(interval time.Duration, checkAPI bool, execute func()) {
+// run polls every interval until the context is cancelled. The first poll is delayed until an interval after the
+// last, when restored from the state file.
+func (x *ServeCommand) run(ctx context.Context, job string, interval func() time.Duration, checkAPI bool, execute func()) {
+	x.polls.Add(1)
+
 	go func() {
+		defer x.polls.Done()
+
+		last := time.Time{}
+		if polled, ok := x.lastPolled.Load(job); ok {
+			last = polled.(time.Time) //nolint:forcetypeassert
+			x.verbose("Delaying the first %s poll by %v", job, max(0, time.Until(last.Add(interval()))).Round(time.Second))
+		}
+
 		for {
-			if !checkAPI || x.apiQuota.IsQuotaAvailable() {
+			// The delay is recalculated whenever the intervals change, so a long wait does not outlast the quota.
+			changed := x.intervals.Changed()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				continue
+			case <-time.After(max(0, time.Until(last.Add(interval())))):
+			}
+
+			if (!checkAPI || x.apiQuota.IsQuotaAvailable()) && ctx.Err() == nil {
 				execute()
+				x.polled(job)
 			}
 
-			time.Sleep(interval)
+			last = time.Now()
 		}
 	}()
 }
 
 func (x *ServeCommand) Include(inverter string) bool {
-	return len(x.Inverters) == 0 || x.Inverters[inverter]
+	settings := x.settings()
+
+	return settings.include(inverter)
 }
 
 func (x *ServeCommand) verbose(format string, v ...any) {
-	if x.Verbose {
+	if x.settings().Verbose {
 		log.Printf(format, v...)
 	}
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/teh-hippo/foxess-exporter/foxess"
@@ -41,6 +47,22 @@ func TestApiUsageWontExceedAllowance(t *testing.T) {
 	require.Error(t, actual)
 }
 
+func TestApiUsageUsesActualQuotaAndBatches(t *testing.T) {
+	t.Parallel()
+
+	serveCommand := buildSubject()
+	serveCommand.RealTimeInterval = 3 * time.Minute
+	serveCommand.StatusInterval = 15 * time.Minute
+	require.NoError(t, serveCommand.validateIntervals())
+
+	// Three batches of inverters triple the real-time calls beyond the default allowance.
+	serveCommand.deviceCache.Set(make([]string, 2*foxess.RealTimeBatchSize+1))
+	require.Error(t, serveCommand.validateIntervals())
+
+	serveCommand.apiQuota.Set(&foxess.APIUsage{Total: 10000, Remaining: 10000, PercentageUsed: 0})
+	require.NoError(t, serveCommand.validateIntervals())
+}
+
 func TestRealTimeIntervalIsClamped(t *testing.T) {
 	t.Parallel()
 
@@ -79,7 +101,6 @@ func TestIncludeWithInverters(t *testing.T) {
 
 func buildSubject() *ServeCommand {
 	return &ServeCommand{
-		Inverters:   map[string]bool{},
 		deviceCache: serve.NewDeviceCache(),
 		apiQuota:    serve.NewAPIQuota(),
 		metrics:     serve.NewMetrics(),
@@ -87,11 +108,18 @@ func buildSubject() *ServeCommand {
 			APIKey: "key",
 			Debug:  false,
 		},
-		Port:             1234,
-		Variables:        []string{},
-		RealTimeInterval: 5 * time.Minute,
-		StatusInterval:   10 * time.Minute,
-		Verbose:          false,
+		ServeOptions: ServeOptions{
+			Inverters:        map[string]bool{},
+			Port:             0,
+			Variables:        []string{},
+			RealTimeInterval: 5 * time.Minute,
+			StatusInterval:   10 * time.Minute,
+			MinInterval:      time.Minute,
+			MaxGap:           15 * time.Minute,
+			ShutdownTimeout:  5 * time.Second,
+			QuotaResetZone:   "UTC",
+			Verbose:          false,
+		},
 	}
 }
 
@@ -108,3 +136,270 @@ func TestIncludeWithoutInverters(t *testing.T) {
 	assert.True(t, serveCommand.Include(id1))
 	assert.True(t, serveCommand.Include(id2))
 }
+
+func fakeFoxESS(t *testing.T, realTimePolled chan<- struct{}) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/op/v0/user/getAccessCount":
+			_, _ = w.Write([]byte(`{"errno":0,"result":{"total":"1440","remaining":"1000"}}`))
+		case "/op/v0/device/list":
+			_, _ = w.Write([]byte(`{"errno":0,"result":{"total":1,"data":[{"deviceSN":"SN1","status":1}]}}`))
+		case "/op/v1/device/real/query":
+			_, _ = w.Write([]byte(`{"errno":0,"result":[{"deviceSN":"SN1","time":"2024-01-01 00:00:00 CST+0800","datas":[{"variable":"pvPower","unit":"kW","value":1}]}]}`))
+
+			select {
+			case realTimePolled <- struct{}{}:
+			default:
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// redirect sends every request to the server rather than FoxESS.
+func redirect(server *httptest.Server) *http.Client {
+	return &http.Client{Transport: &redirectTransport{server: server}} //nolint:exhaustruct
+}
+
+type redirectTransport struct {
+	server *httptest.Server
+}
+
+func (x *redirectTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.URL.Scheme, request.URL.Host = "http", x.server.Listener.Addr().String()
+
+	return x.server.Client().Transport.RoundTrip(request) //nolint:wrapcheck
+}
+
+func serveInBackground(t *testing.T, subject *ServeCommand) (context.CancelFunc, <-chan error) {
+	t.Helper()
+
+	require.NoError(t, subject.prepare())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- subject.serve(ctx)
+	}()
+
+	return cancel, done
+}
+
+func TestServeShutsDownGracefully(t *testing.T) {
+	t.Parallel()
+
+	realTimePolled := make(chan struct{}, 1)
+	subject := buildSubject()
+	subject.config.Client = redirect(fakeFoxESS(t, realTimePolled))
+
+	var flushed atomic.Bool
+
+	subject.onShutdown(func(context.Context) error {
+		flushed.Store(true)
+
+		return nil
+	})
+
+	cancel, done := serveInBackground(t, subject)
+
+	select {
+	case <-realTimePolled:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "real-time data was not polled")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "serve did not shut down")
+	}
+
+	assert.True(t, flushed.Load())
+}
+
+func TestServeShutsDownBeforeFirstPoll(t *testing.T) {
+	t.Parallel()
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(unavailable.Close)
+
+	subject := buildSubject()
+	subject.config.Client = redirect(unavailable)
+
+	cancel, done := serveInBackground(t, subject)
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "serve did not shut down while waiting for the API quota")
+	}
+}
+
+func TestServeSavesStateOnShutdown(t *testing.T) {
+	t.Parallel()
+
+	realTimePolled := make(chan struct{}, 1)
+	subject := buildSubject()
+	subject.config.Client = redirect(fakeFoxESS(t, realTimePolled))
+	subject.StateFile = filepath.Join(t.TempDir(), "state.json")
+	subject.Integrate = []string{"pvPower"}
+
+	cancel, done := serveInBackground(t, subject)
+
+	select {
+	case <-realTimePolled:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "real-time data was not polled")
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+
+	state, err := serve.LoadState(subject.StateFile)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, state.Energy["SN1"]["pvPower"].LastValue)
+}
+
+func TestPollingResumesWhenTheQuotaResets(t *testing.T) {
+	t.Parallel()
+
+	var polls atomic.Int32
+
+	subject := buildSubject()
+	subject.intervals = serve.NewIntervals(10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond, true)
+	subject.lastPolled.Store(serve.JobRealTime, time.Now())
+
+	// With the quota exhausted an hour before it resets, polling waits for the reset.
+	subject.intervals.Recalculate(0, time.Hour, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	subject.run(ctx, serve.JobRealTime, subject.intervals.RealTime, false, func() { polls.Add(1) })
+
+	t.Cleanup(func() {
+		cancel()
+		subject.polls.Wait()
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), polls.Load())
+
+	// Once the quota is replenished, the waiting poll is rescheduled rather than left to the previous interval.
+	subject.intervals.Recalculate(1e9, 24*time.Hour, 1)
+	assert.Eventually(t, func() bool { return polls.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRestoredStateDelaysPolls(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	now := time.Now()
+	state := &serve.State{
+		Energy:   nil,
+		RealTime: map[string]map[string]serve.SampleState{"SN1": {"pvPower": {Value: 1, Unit: "kW", Time: now, Seen: now}}},
+		Devices:  []foxess.Device{{DeviceSerialNumber: "SN1", Status: foxess.StatusOnline}}, //nolint:exhaustruct
+		Quota:    &serve.QuotaState{Total: 1440, Remaining: 1000, PercentageUsed: 30.6, ObservedAt: now, BaselineTime: now, BaselineUsed: 440},
+		Polls:    map[string]time.Time{serve.JobQuota: now, serve.JobStatus: now, serve.JobRealTime: now},
+	}
+
+	subject := buildSubject()
+	subject.config.Client = redirect(server)
+	subject.StateFile = filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, state.Save(subject.StateFile))
+
+	cancel, done := serveInBackground(t, subject)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, 1, testutil.CollectAndCount(subject.metrics.Registry, "foxess_realtime_data"))
+	assert.Equal(t, []string{"SN1"}, subject.deviceCache.Peek())
+
+	recorder := httptest.NewRecorder()
+	subject.health.Readiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	cancel()
+	require.NoError(t, <-done)
+	assert.Zero(t, requests.Load(), "no polls were due")
+}
+
+func TestServeFetchesOnScrape(t *testing.T) {
+	t.Parallel()
+
+	var realTimeCalls atomic.Int32
+
+	realTimePolled := make(chan struct{}, 10)
+	subject := buildSubject()
+	subject.config.Client = redirect(fakeFoxESS(t, realTimePolled))
+	subject.OnScrape = true
+
+	cancel, done := serveInBackground(t, subject)
+
+	require.Eventually(t, func() bool {
+		usage, _ := subject.apiQuota.Current()
+
+		return usage != nil && subject.deviceCache.Peek() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case <-realTimePolled:
+		require.Fail(t, "real-time data was polled without a scrape")
+	default:
+	}
+
+	for range 3 {
+		assert.Equal(t, 1, testutil.CollectAndCount(subject.metrics.Registry, "foxess_realtime_data"))
+	}
+
+	for len(realTimePolled) > 0 {
+		<-realTimePolled
+		realTimeCalls.Add(1)
+	}
+
+	assert.Equal(t, int32(1), realTimeCalls.Load(), "later scrapes are served from the cache")
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestOnScrapeIsReadyBeforeTheFirstScrape(t *testing.T) {
+	t.Parallel()
+
+	realTimePolled := make(chan struct{}, 1)
+	subject := buildSubject()
+	subject.config.Client = redirect(fakeFoxESS(t, realTimePolled))
+	subject.OnScrape = true
+
+	cancel, done := serveInBackground(t, subject)
+
+	assert.Eventually(t, func() bool {
+		recorder := httptest.NewRecorder()
+		subject.health.Readiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		return recorder.Code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, realTimePolled, "readiness does not wait for a scrape")
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+	"github.com/teh-hippo/foxess-exporter/sink"
+	"github.com/teh-hippo/foxess-exporter/util"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigPollInterval is how often the config file is checked for changes.
+const ConfigPollInterval = 30 * time.Second
+
+// ServeOptions are the serve settings, given as flags, environment variables or in the config file.
+type ServeOptions struct {
+	Port             int           `short:"p" long:"port"              description:"Port to listen on"                  env:"PORT"               required:"true" default:"2112" yaml:"port"`
+	Inverters        InverterSet   `short:"i" long:"inverter"          description:"Inverter serial numbers"            env:"INVERTERS"          env-delim:""                   yaml:"inverters"`
+	Variables        []string      `short:"V" long:"variable"          description:"Variables to retrieve"              env:"VARIABLES"          env-delim:""                   yaml:"variables"`
+	RealTimeInterval time.Duration `short:"R" long:"realtime-interval" description:"Update frequency of real-time data" env:"REAL_TIME_INTERVAL" required:"true" default:"3m"   yaml:"realtime-interval"`
+	StatusInterval   time.Duration `short:"S" long:"status-interval"   description:"Update frequency of devices status" env:"STATUS_INTERVAL"    required:"true" default:"15m"  yaml:"status-interval"`
+	Verbose          bool          `short:"v" long:"verbose"           description:"Enable verbose logging"             env:"VERBOSE"                                           yaml:"verbose"`
+
+	MappingFile     string `short:"m" long:"mapping-file"      description:"YAML file mapping variables to metrics"                     env:"MAPPING_FILE"                  yaml:"mapping-file"`
+	NoGenericMetric bool   `short:"G" long:"no-generic-metric" description:"Do not export foxess_realtime_data"                         env:"NO_GENERIC_METRIC"             yaml:"no-generic-metric"`
+	StaleIntervals  int    `short:"s" long:"stale-intervals"   description:"Intervals before unrefreshed series are removed, 0 to keep" env:"STALE_INTERVALS"   default:"5" yaml:"stale-intervals"`
+	DataTimestamps  bool   `short:"T" long:"data-timestamps"   description:"Timestamp samples with the FoxESS data time"                env:"DATA_TIMESTAMPS"               yaml:"data-timestamps"`
+
+	QuotaResetZone string        `short:"z" long:"quota-reset-zone" description:"Time zone of the daily API quota reset"               env:"QUOTA_RESET_ZONE" default:"Local" yaml:"quota-reset-zone"`
+	Adaptive       bool          `short:"A" long:"adaptive"         description:"Adapt intervals to the remaining API quota"           env:"ADAPTIVE"                         yaml:"adaptive"`
+	MinInterval    time.Duration `short:"F" long:"min-interval"     description:"Shortest interval when adapting to the API quota"     env:"MIN_INTERVAL"     default:"1m"    yaml:"min-interval"`
+	OnScrape       bool          `short:"O" long:"on-scrape"        description:"Fetch real-time data when scraped, not on a schedule" env:"ON_SCRAPE"                        yaml:"on-scrape"`
+
+	Integrate     []string      `short:"I" long:"integrate"      description:"Power variables to integrate into energy counters"     env:"INTEGRATE"      env-delim:""  yaml:"integrate"`
+	MaxGap        time.Duration `short:"g" long:"max-gap"        description:"Longest gap between samples to integrate across"       env:"MAX_GAP"        default:"15m" yaml:"max-gap"`
+	Backfill      bool          `          long:"backfill"       description:"Backfill gaps beyond the max gap via remote write"     env:"BACKFILL"                     yaml:"backfill"`
+	BackfillLimit time.Duration `short:"B" long:"backfill-limit" description:"Longest period to backfill, ending where the gap ends" env:"BACKFILL_LIMIT" default:"72h" yaml:"backfill-limit"`
+
+	ShutdownTimeout time.Duration `short:"W" long:"shutdown-timeout" description:"Time allowed to finish polls and flush on shutdown"      env:"SHUTDOWN_TIMEOUT" default:"30s" yaml:"shutdown-timeout"`
+	ReadyIntervals  int           `short:"r" long:"ready-intervals"  description:"Real-time intervals without a poll before /readyz fails" env:"READY_INTERVALS"  default:"3"   yaml:"ready-intervals"`
+	StateFile       string        `short:"f" long:"state-file"       description:"File to persist state across restarts"                   env:"STATE_FILE"                     yaml:"state-file"`
+
+	Overrides    map[string]InverterOverride `no-flag:"true" yaml:"overrides"`
+	Aggregations serve.Aggregations          `no-flag:"true" yaml:"aggregations"`
+	Derived      map[string]string           `no-flag:"true" yaml:"derived"`
+
+	RemoteWrite sink.RemoteWriteConfig `group:"Remote write" namespace:"remote-write" env-namespace:"REMOTE_WRITE" yaml:"remote-write"`
+	InfluxDB    sink.InfluxDBConfig    `group:"InfluxDB"     namespace:"influxdb"     env-namespace:"INFLUXDB"     yaml:"influxdb"`
+	MQTT        sink.MQTTConfig        `group:"MQTT"         namespace:"mqtt"         env-namespace:"MQTT"         yaml:"mqtt"`
+	OTLP        sink.OTLPConfig        `group:"OTLP"         namespace:"otlp"         env-namespace:"OTLP"         yaml:"otlp"`
+}
+
+// InverterOverride adjusts the settings of a single inverter.
+type InverterOverride struct {
+	Variables       []string `yaml:"variables"`
+	Exclude         bool     `yaml:"exclude"`
+	BatteryCapacity float64  `yaml:"battery-capacity"`
+}
+
+// InverterSet is the set of inverter serial numbers to include, given as a list in the config file.
+type InverterSet map[string]bool
+
+func (x *InverterSet) UnmarshalYAML(value *yaml.Node) error {
+	var serialNumbers []string
+	if err := value.Decode(&serialNumbers); err != nil {
+		return fmt.Errorf("inverters must be a list of serial numbers: %w", err)
+	}
+
+	*x = make(InverterSet, len(serialNumbers))
+	for _, serialNumber := range serialNumbers {
+		(*x)[serialNumber] = true
+	}
+
+	return nil
+}
+
+// realTimeQuery is a set of inverters polled for the same variables.
+type realTimeQuery struct {
+	inverters []string
+	variables []string
+}
+
+func (x *ServeOptions) include(inverter string) bool {
+	return (len(x.Inverters) == 0 || x.Inverters[inverter]) && !x.Overrides[inverter].Exclude
+}
+
+// filteredInverters is the included inverters when filtered by serial number, or nil when the device list is used.
+func (x *ServeOptions) filteredInverters() []string {
+	var ids []string
+
+	for deviceID := range x.Inverters {
+		if x.include(deviceID) {
+			ids = append(ids, deviceID)
+		}
+	}
+
+	slices.Sort(ids)
+
+	return ids
+}
+
+// realTimeQueries groups the included inverters by the variables to poll for them.
+func (x *ServeOptions) realTimeQueries(inverters []string) []realTimeQuery {
+	var queries []realTimeQuery
+
+	for _, inverter := range inverters {
+		if !x.include(inverter) {
+			continue
+		}
+
+		variables := x.Variables
+		if override, ok := x.Overrides[inverter]; ok && override.Variables != nil {
+			variables = override.Variables
+		}
+
+		i := slices.IndexFunc(queries, func(query realTimeQuery) bool { return slices.Equal(query.variables, variables) })
+		if i < 0 {
+			queries = append(queries, realTimeQuery{inverters: nil, variables: variables})
+			i = len(queries) - 1
+		}
+
+		queries[i].inverters = append(queries[i].inverters, inverter)
+	}
+
+	return queries
+}
+
+// realTimeBatches is the number of API calls each real-time poll makes.
+func (x *ServeOptions) realTimeBatches(inverters []string) int {
+	batches := 0
+	for _, query := range x.realTimeQueries(inverters) {
+		batches += (len(query.inverters) + foxess.RealTimeBatchSize - 1) / foxess.RealTimeBatchSize
+	}
+
+	return max(1, batches)
+}
+
+// validateIntervals clamps the intervals, reporting whether they would exceed the daily allowance.
+func (x *ServeOptions) validateIntervals(allowance float64, inverters []string) error {
+	const oneDay time.Duration = 24 * time.Hour
+	x.RealTimeInterval = util.Clamp(x.RealTimeInterval, time.Minute, oneDay)
+	x.StatusInterval = util.Clamp(x.StatusInterval, time.Minute, oneDay)
+
+	apiCallsPerDay := allowance
+	realTimeCalls := oneDay / x.RealTimeInterval * time.Duration(x.realTimeBatches(inverters))
+	apiCallsPerDay -= float64(realTimeCalls)
+	statusCalls := oneDay / x.StatusInterval
+	apiCallsPerDay -= float64(statusCalls)
+	quotaCalls := oneDay / serve.QuotaInterval
+	apiCallsPerDay -= float64(quotaCalls)
+
+	if apiCallsPerDay < 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidArgument, "current intervals would result in API usage exceeding the maximum daily allowance")
+	}
+
+	return nil
+}
+
+// aggregations are the station aggregations, with those configured applied over the defaults.
+func (x *ServeOptions) aggregations() serve.Aggregations {
+	return serve.DefaultAggregations().Merge(x.Aggregations)
+}
+
+// batteryCapacities are the configured battery capacities of each inverter, in kWh.
+func (x *ServeOptions) batteryCapacities() map[string]float64 {
+	capacities := make(map[string]float64)
+
+	for inverter, override := range x.Overrides {
+		if override.BatteryCapacity > 0 {
+			capacities[inverter] = override.BatteryCapacity
+		}
+	}
+
+	return capacities
+}
+
+func (x *ServeOptions) validate() error {
+	if x.RealTimeInterval <= 0 || x.StatusInterval <= 0 || x.MinInterval <= 0 || x.ShutdownTimeout <= 0 || x.MaxGap <= 0 {
+		return fmt.Errorf("%w: intervals and timeouts must be positive", ErrInvalidArgument)
+	}
+
+	if x.Backfill && (x.BackfillLimit <= 0 || x.RemoteWrite.URL == "" || x.StateFile == "") {
+		return fmt.Errorf("%w: backfill requires remote write, a state file and a positive limit", ErrInvalidArgument)
+	}
+
+	if x.StaleIntervals < 0 || x.ReadyIntervals < 0 {
+		return fmt.Errorf("%w: stale and ready intervals cannot be negative", ErrInvalidArgument)
+	}
+
+	if err := x.aggregations().Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
+
+	if _, err := serve.ParseDerivations(x.Derived); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+	}
+
+	return nil
+}
+
+// loadConfig applies the config file, if any, over the settings given as flags and environment variables.
+func (x *ServeCommand) loadConfig() error {
+	x.flagOptions = x.ServeOptions
+
+	if x.ConfigFile == "" {
+		return x.validate()
+	}
+
+	options, err := x.readConfig()
+	if err != nil {
+		return err
+	}
+
+	x.ServeOptions = options
+
+	return nil
+}
+
+// readConfig layers the config file over the flag and environment settings, so only the keys present in the file
+// replace them.
+func (x *ServeCommand) readConfig() (ServeOptions, error) {
+	options := x.flagOptions
+
+	file, err := os.Open(x.ConfigFile)
+	if err != nil {
+		return options, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&options); err != nil && !errors.Is(err, io.EOF) {
+		return options, fmt.Errorf("%w: invalid config file %s: %w", ErrInvalidArgument, x.ConfigFile, err)
+	}
+
+	return options, options.validate()
+}
+
+// settings returns the current settings, which may be replaced by a reload at any time.
+func (x *ServeCommand) settings() ServeOptions {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	return x.ServeOptions
+}
+
+// reload re-reads the config file, keeping the current settings if it is invalid.
+func (x *ServeCommand) reload() {
+	options, err := x.readConfig()
+	if err != nil {
+		log.Printf("Unable to reload %s, keeping the current settings: %v", x.ConfigFile, err)
+
+		return
+	}
+
+	x.apply(options)
+	log.Printf("Reloaded %s", x.ConfigFile)
+}
+
+// apply replaces the settings that can change while serving, warning about the others which need a restart.
+func (x *ServeCommand) apply(options ServeOptions) {
+	current := x.settings()
+	if options.Port != current.Port || options.MappingFile != current.MappingFile || options.NoGenericMetric != current.NoGenericMetric ||
+		options.DataTimestamps != current.DataTimestamps || options.QuotaResetZone != current.QuotaResetZone || options.ShutdownTimeout != current.ShutdownTimeout ||
+		options.StateFile != current.StateFile || options.OnScrape != current.OnScrape {
+		log.Printf("Warning: changes to the port, mappings, generic metric, timestamps, quota reset zone, shutdown timeout, state file or on-scrape mode require a restart")
+	}
+
+	if !reflect.DeepEqual(options.RemoteWrite, current.RemoteWrite) || !reflect.DeepEqual(options.InfluxDB, current.InfluxDB) ||
+		!reflect.DeepEqual(options.MQTT, current.MQTT) || !reflect.DeepEqual(options.OTLP, current.OTLP) {
+		log.Printf("Warning: changes to the push destinations require a restart")
+	}
+
+	if err := options.validateIntervals(x.dailyAllowance(), x.deviceCache.Peek()); err != nil && !options.Adaptive {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Backfill pushes through the remote write opened, and relies on the state file read, when serving started.
+	if options.Backfill && (x.remoteWrite == nil || current.StateFile == "") {
+		log.Printf("Warning: backfill requires remote write and a state file from the start, so is only enabled on restart")
+
+		options.Backfill = current.Backfill
+	}
+
+	x.mutex.Lock()
+	x.Inverters, x.Variables, x.Overrides = options.Inverters, options.Variables, options.Overrides
+	x.RealTimeInterval, x.StatusInterval, x.MinInterval, x.Adaptive = options.RealTimeInterval, options.StatusInterval, options.MinInterval, options.Adaptive
+	x.StaleIntervals, x.ReadyIntervals, x.Verbose = options.StaleIntervals, options.ReadyIntervals, options.Verbose
+	x.Aggregations, x.Derived = options.Aggregations, options.Derived
+	x.Integrate, x.MaxGap = options.Integrate, options.MaxGap
+	x.Backfill, x.BackfillLimit = options.Backfill, options.BackfillLimit
+	x.mutex.Unlock()
+
+	x.metrics.ConfigureStations(options.aggregations(), options.batteryCapacities())
+	x.metrics.ConfigureIntegration(options.Integrate, options.MaxGap)
+
+	if derivations, err := serve.ParseDerivations(options.Derived); err == nil {
+		x.metrics.ConfigureDerived(derivations)
+	}
+
+	x.intervals.Configure(options.RealTimeInterval, options.StatusInterval, options.MinInterval, options.Adaptive)
+	x.adapt()
+
+	if ids := options.filteredInverters(); len(ids) > 0 {
+		x.deviceCache.Set(ids)
+	} else if usage, _ := x.apiQuota.Current(); len(current.Inverters) > 0 && usage != nil && usage.Remaining > 0 {
+		// Without a filter the devices come from the device list, which is refreshed now rather than at the next poll.
+		x.updateDeviceStatus()
+		x.polled(serve.JobStatus)
+	}
+}
+
+// watchConfig reloads the config file on SIGHUP, or once its modification time changes.
+func (x *ServeCommand) watchConfig(ctx context.Context) {
+	if x.ConfigFile == "" {
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	modified := x.configModified()
+
+	x.polls.Add(1)
+
+	go func() {
+		defer x.polls.Done()
+		defer signal.Stop(hangup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+			case <-time.After(ConfigPollInterval):
+				if x.configModified().Equal(modified) {
+					continue
+				}
+			}
+
+			modified = x.configModified()
+			x.reload()
+		}
+	}()
+}
+
+func (x *ServeCommand) configModified() time.Time {
+	info, err := os.Stat(x.ConfigFile)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+	"github.com/teh-hippo/foxess-exporter/sink"
+)
+
+func writeConfig(t *testing.T, fileName, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(fileName, []byte(content), 0o600))
+}
+
+func TestConfigFileOverridesFlags(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "serve.yaml")
+	writeConfig(t, fileName, `
+inverters: [SN1, SN2]
+realtime-interval: 5m
+aggregations:
+  loadsPower: max
+overrides:
+  SN2:
+    variables: [pvPower]
+    battery-capacity: 10.4
+remote-write:
+  url: http://localhost:9090/api/v1/write
+  bearer-token: secret
+  min-backoff: 2s
+`)
+
+	subject := buildSubject()
+	subject.ConfigFile = fileName
+	subject.Variables = []string{"SoC"}
+	require.NoError(t, subject.loadConfig())
+
+	assert.Equal(t, InverterSet{"SN1": true, "SN2": true}, subject.Inverters)
+	assert.Equal(t, 5*time.Minute, subject.RealTimeInterval)
+	assert.Equal(t, 10*time.Minute, subject.StatusInterval, "flag value kept when absent from the file")
+	assert.Equal(t, []string{"SoC"}, subject.Variables, "flag value kept when absent from the file")
+	assert.Equal(t, []string{"pvPower"}, subject.Overrides["SN2"].Variables)
+	assert.Equal(t, map[string]float64{"SN2": 10.4}, subject.batteryCapacities())
+	assert.Equal(t, serve.AggregationMax, subject.aggregations()["loadsPower"])
+	assert.Equal(t, serve.AggregationSum, subject.aggregations()["pvPower"])
+	assert.Equal(t, "http://localhost:9090/api/v1/write", subject.RemoteWrite.URL)
+	assert.Equal(t, "secret", subject.RemoteWrite.BearerToken)
+	assert.Equal(t, 2*time.Second, subject.RemoteWrite.MinBackoff)
+}
+
+func TestConfigFileIsValidated(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "serve.yaml")
+	subject := buildSubject()
+	subject.ConfigFile = fileName
+
+	writeConfig(t, fileName, "realtime-intervals: 5m\n")
+	require.ErrorIs(t, subject.loadConfig(), ErrInvalidArgument)
+
+	writeConfig(t, fileName, "status-interval: -1m\n")
+	require.ErrorIs(t, subject.loadConfig(), ErrInvalidArgument)
+
+	writeConfig(t, fileName, "inverters: SN1\n")
+	require.ErrorIs(t, subject.loadConfig(), ErrInvalidArgument)
+
+	writeConfig(t, fileName, "aggregations:\n  pvPower: median\n")
+	require.ErrorIs(t, subject.loadConfig(), ErrInvalidArgument)
+
+	writeConfig(t, fileName, "derived:\n  solarShare: pvPower / (loadsPower\n")
+	require.ErrorIs(t, subject.loadConfig(), ErrInvalidArgument)
+
+	writeConfig(t, fileName, "backfill: true\nremote-write:\n  url: http://localhost:9090/api/v1/write\n")
+	require.ErrorIs(t, subject.loadConfig(), ErrInvalidArgument)
+}
+
+func TestRealTimeQueriesApplyOverrides(t *testing.T) {
+	t.Parallel()
+
+	subject := ServeOptions{ //nolint:exhaustruct
+		Variables: []string{"pvPower", "SoC"},
+		Overrides: map[string]InverterOverride{
+			"SN2": {Variables: []string{"pvPower"}, Exclude: false},
+			"SN3": {Variables: nil, Exclude: true},
+			"SN4": {Variables: []string{"pvPower"}, Exclude: false},
+		},
+	}
+
+	assert.Equal(t, []realTimeQuery{
+		{inverters: []string{"SN1", "SN5"}, variables: []string{"pvPower", "SoC"}},
+		{inverters: []string{"SN2", "SN4"}, variables: []string{"pvPower"}},
+	}, subject.realTimeQueries([]string{"SN1", "SN2", "SN3", "SN4", "SN5"}))
+	assert.Equal(t, 2, subject.realTimeBatches([]string{"SN1", "SN2"}))
+	assert.False(t, subject.include("SN3"))
+}
+
+func TestReloadAppliesSettings(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "serve.yaml")
+	writeConfig(t, fileName, "variables: [pvPower]\n")
+
+	subject := buildSubject()
+	subject.ConfigFile = fileName
+	require.NoError(t, subject.loadConfig())
+	require.NoError(t, subject.prepare())
+
+	writeConfig(t, fileName, `
+variables: [SoC]
+inverters: [SN1]
+realtime-interval: 7m
+port: 1234
+`)
+	subject.reload()
+
+	settings := subject.settings()
+	assert.Equal(t, []string{"SoC"}, settings.Variables)
+	assert.Equal(t, 7*time.Minute, subject.intervals.RealTime())
+	assert.Equal(t, []string{"SN1"}, subject.deviceCache.Peek())
+	assert.Equal(t, 0, settings.Port, "the port is only applied on restart")
+
+	writeConfig(t, fileName, "variables: [\n")
+	subject.reload()
+	assert.Equal(t, []string{"SoC"}, subject.settings().Variables, "an invalid file keeps the current settings")
+}
+
+func TestReloadAppliesBackfill(t *testing.T) {
+	t.Parallel()
+
+	directory := t.TempDir()
+	fileName := filepath.Join(directory, "serve.yaml")
+	initial := "state-file: " + filepath.Join(directory, "state.json") + "\n"
+	writeConfig(t, fileName, initial)
+
+	subject := buildSubject()
+	subject.ConfigFile = fileName
+	subject.RemoteWrite = sink.RemoteWriteConfig{ //nolint:exhaustruct
+		URL:         "http://127.0.0.1:1/api/v1/write",
+		BatchSize:   100,
+		HTTPConfig:  sink.HTTPConfig{Timeout: time.Second},                                                  //nolint:exhaustruct
+		QueueConfig: sink.QueueConfig{QueueSize: 10, MinBackoff: time.Millisecond, MaxBackoff: time.Second}, //nolint:exhaustruct
+	}
+	require.NoError(t, subject.loadConfig())
+	require.NoError(t, subject.prepare())
+
+	writeConfig(t, fileName, initial+"backfill: true\nbackfill-limit: 48h\n")
+	subject.reload()
+	assert.True(t, subject.settings().Backfill)
+	assert.Equal(t, 48*time.Hour, subject.settings().BackfillLimit)
+
+	// Remote write added by the same reload is not open yet, so cannot be backfilled through.
+	other := buildSubject()
+	other.ConfigFile = filepath.Join(directory, "other.yaml")
+	writeConfig(t, other.ConfigFile, "")
+	require.NoError(t, other.loadConfig())
+	require.NoError(t, other.prepare())
+
+	writeConfig(t, other.ConfigFile, initial+"remote-write:\n  url: http://127.0.0.1:1/api/v1/write\nbackfill: true\nbackfill-limit: 48h\n")
+	other.reload()
+	assert.False(t, other.settings().Backfill)
+	assert.Equal(t, 48*time.Hour, other.settings().BackfillLimit)
+}
+
+func TestReloadWithoutFilterRefreshesDevices(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "serve.yaml")
+	writeConfig(t, fileName, "inverters: [SN9]\n")
+
+	subject := buildSubject()
+	subject.config.Client = redirect(fakeFoxESS(t, nil))
+	subject.ConfigFile = fileName
+	require.NoError(t, subject.loadConfig())
+	require.NoError(t, subject.prepare())
+	subject.deviceCache.Set(subject.filteredInverters())
+	subject.apiQuota.Set(&foxess.APIUsage{Total: 1440, Remaining: 1000, PercentageUsed: 30.6})
+
+	writeConfig(t, fileName, "variables: [pvPower]\n")
+	subject.reload()
+	assert.Equal(t, []string{"SN1"}, subject.deviceCache.Peek(), "the device list is refreshed once the filter is removed")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+	"github.com/teh-hippo/foxess-exporter/sink"
+)
+
+// openSinks creates the configured push destinations, which are flushed on shutdown.
+func (x *ServeCommand) openSinks(mappings serve.Mappings) error {
+	if x.RemoteWrite.URL != "" {
+		remoteWrite, err := sink.NewRemoteWrite(&x.RemoteWrite)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+
+		x.remoteWrite = remoteWrite
+		x.addSink(remoteWrite)
+	}
+
+	if x.InfluxDB.URL != "" {
+		influxDB, err := sink.NewInfluxDB(&x.InfluxDB)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+
+		x.addSink(influxDB)
+	}
+
+	var counters []string
+
+	for variable, mapping := range mappings {
+		if mapping.Type == serve.MetricTypeCounter {
+			counters = append(counters, variable)
+		}
+	}
+
+	if x.MQTT.Broker != "" {
+		mqtt, err := sink.NewMQTT(&x.MQTT, counters)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+
+		x.addSink(mqtt)
+	}
+
+	if x.OTLP.Endpoint != "" {
+		otlp, err := sink.NewOTLP(context.Background(), &x.OTLP, counters)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+
+		x.addSink(otlp)
+	}
+
+	return nil
+}
+
+func (x *ServeCommand) addSink(s sink.Sink) {
+	x.sinks = append(x.sinks, s)
+	x.onShutdown(s.Close)
+}
+
+// writeSinks hands the latest real-time data to each sink, which deliver it in the background. Remote write is held
+// back from inverters being backfilled, as the receiver rejects samples older than those it already has.
+func (x *ServeCommand) writeSinks(data []foxess.RealTimeData) {
+	for _, s := range x.sinks {
+		batch := data
+		if s == x.remoteWrite {
+			batch = x.holdBack(data)
+		}
+
+		if err := s.Write(batch); err != nil {
+			log.Printf("Unable to push real-time data: %v", err)
+		}
+	}
+}
+
+// writeDevices hands the included devices to the sinks that use them.
+func (x *ServeCommand) writeDevices(devices []foxess.Device, include func(string) bool) {
+	included := make([]foxess.Device, 0, len(devices))
+
+	for _, device := range devices {
+		if include(device.DeviceSerialNumber) {
+			included = append(included, device)
+		}
+	}
+
+	for _, s := range x.sinks {
+		if writer, ok := s.(sink.DeviceWriter); ok {
+			if err := writer.WriteDevices(included); err != nil {
+				log.Printf("Unable to push device status: %v", err)
+			}
+		}
+	}
+}
+
+// writeQuota hands the API quota to the sinks that deliver it.
+func (x *ServeCommand) writeQuota(usage *foxess.APIUsage) {
+	for _, s := range x.sinks {
+		if writer, ok := s.(sink.QuotaWriter); ok {
+			if err := writer.WriteQuota(usage); err != nil {
+				log.Printf("Unable to push API quota: %v", err)
+			}
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package serve_test
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/teh-hippo/foxess-exporter/foxess"
 	"github.com/teh-hippo/foxess-exporter/serve"
 )
@@ -24,3 +29,97 @@ func TestQuotaAvailable(t *testing.T) {
 	assertThat(0, false)
 	assertThat(1, true)
 }
+
+func TestQuotaMetricsProjectExhaustion(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewAPIQuota()
+	subject.SetResetLocation(time.UTC)
+
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	subject.SetAt(&foxess.APIUsage{Total: 1440, Remaining: 1000, PercentageUsed: 30.5555}, start)
+	// 60 calls in an hour leaves 940, which lasts another 15h40m, beyond the reset at midnight.
+	subject.SetAt(&foxess.APIUsage{Total: 1440, Remaining: 940, PercentageUsed: 34.7222}, start.Add(time.Hour))
+	require.Equal(t, 0, testutil.CollectAndCount(subject, "foxess_api_quota_exhaustion_timestamp_seconds"))
+
+	// 720 calls over two hours leaves 280, which lasts another 46m40s at 360 calls an hour.
+	subject.SetAt(&foxess.APIUsage{Total: 1440, Remaining: 280, PercentageUsed: 80.5555}, start.Add(2*time.Hour))
+
+	expected := `
+# HELP foxess_api_quota_consumption_rate FoxESS API calls consumed per second since the quota last reset.
+# TYPE foxess_api_quota_consumption_rate gauge
+foxess_api_quota_consumption_rate 0.1
+# HELP foxess_api_quota_exhaustion_timestamp_seconds Projected time the FoxESS API quota runs out at the current consumption rate.
+# TYPE foxess_api_quota_exhaustion_timestamp_seconds gauge
+foxess_api_quota_exhaustion_timestamp_seconds 1.7041204e+09
+# HELP foxess_api_quota_remaining FoxESS API calls remaining today.
+# TYPE foxess_api_quota_remaining gauge
+foxess_api_quota_remaining 280
+# HELP foxess_api_quota_reset_timestamp_seconds Time the FoxESS API quota next resets.
+# TYPE foxess_api_quota_reset_timestamp_seconds gauge
+foxess_api_quota_reset_timestamp_seconds 1.7041536e+09
+# HELP foxess_api_quota_total Daily allowance of FoxESS API calls.
+# TYPE foxess_api_quota_total gauge
+foxess_api_quota_total 1440
+`
+	require.NoError(t, testutil.CollectAndCompare(subject, strings.NewReader(expected), "foxess_api_quota_consumption_rate",
+		"foxess_api_quota_exhaustion_timestamp_seconds", "foxess_api_quota_remaining", "foxess_api_quota_reset_timestamp_seconds", "foxess_api_quota_total"))
+}
+
+func TestQuotaRateRestartsAfterReset(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewAPIQuota()
+	subject.SetResetLocation(time.UTC)
+
+	start := time.Date(2024, time.January, 1, 23, 0, 0, 0, time.UTC)
+	subject.SetAt(&foxess.APIUsage{Total: 1440, Remaining: 100, PercentageUsed: 93}, start)
+	subject.SetAt(&foxess.APIUsage{Total: 1440, Remaining: 1430, PercentageUsed: 1}, start.Add(2*time.Hour))
+
+	require.Equal(t, 0, testutil.CollectAndCount(subject, "foxess_api_quota_exhaustion_timestamp_seconds"))
+}
+
+func TestQuotaIsRestoredUntilReset(t *testing.T) {
+	t.Parallel()
+
+	observedAt := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	original := serve.NewAPIQuota()
+	original.SetResetLocation(time.UTC)
+	original.SetAt(&foxess.APIUsage{Total: 1440, Remaining: 1000, PercentageUsed: 30.5555}, observedAt.Add(-time.Hour))
+	original.SetAt(&foxess.APIUsage{Total: 1440, Remaining: 940, PercentageUsed: 34.7222}, observedAt)
+	state := original.Snapshot()
+
+	restored := serve.NewAPIQuota()
+	restored.SetResetLocation(time.UTC)
+	require.False(t, restored.Restore(state, observedAt.Add(12*time.Hour)), "the quota has reset since")
+	require.True(t, restored.Restore(state, observedAt.Add(time.Hour)))
+	require.False(t, restored.Restore(state, observedAt.Add(time.Hour)), "the quota is already known")
+
+	usage, _ := restored.Current()
+	assert.InDelta(t, 940.0, usage.Remaining, 0)
+	assert.True(t, restored.IsQuotaAvailable())
+
+	expected, err := testutil.CollectAndFormat(original, expfmt.TypeTextPlain)
+	require.NoError(t, err)
+
+	actual, err := testutil.CollectAndFormat(restored, expfmt.TypeTextPlain)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+func TestQuotaCountsRequestsThatReachFoxESS(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewAPIQuota()
+	subject.ObserveRequest(&foxess.RequestEvent{Outcome: foxess.OutcomeSuccess}) //nolint:exhaustruct
+
+	usage, _ := subject.Current()
+	assert.Nil(t, usage, "nothing to count against until the usage is known")
+
+	subject.Set(&foxess.APIUsage{Total: 1000, Remaining: 501, PercentageUsed: 49.9})
+	subject.ObserveRequest(&foxess.RequestEvent{Outcome: foxess.OutcomeErrorResponse})  //nolint:exhaustruct
+	subject.ObserveRequest(&foxess.RequestEvent{Outcome: foxess.OutcomeRequestFailure}) //nolint:exhaustruct
+
+	usage, _ = subject.Current()
+	assert.Equal(t, &foxess.APIUsage{Total: 1000, Remaining: 500, PercentageUsed: 50}, usage)
+}
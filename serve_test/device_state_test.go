@@ -0,0 +1,63 @@
+package serve_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestDeviceStateTransitions(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	subject := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+	includeAll := func(string) bool { return true }
+	device := foxess.Device{ //nolint:exhaustruct
+		DeviceSerialNumber: "SN1",
+		StationName:        "Home",
+		ProductType:        "H3",
+		DeviceType:         "H3-10.0-E",
+		Status:             foxess.StatusOnline,
+	}
+
+	subject.UpdateStatus([]foxess.Device{device}, includeAll)
+
+	now = now.Add(time.Hour)
+	device.Status = foxess.StatusFault
+	subject.UpdateStatus([]foxess.Device{device}, includeAll)
+
+	now = now.Add(10 * time.Minute)
+	device.Status = foxess.StatusOnline
+	subject.UpdateStatus([]foxess.Device{device}, includeAll)
+
+	now = now.Add(5 * time.Minute)
+
+	expected := `
+# HELP foxess_device_state Whether the inverter is in the state, with details from the device list.
+# TYPE foxess_device_state gauge
+foxess_device_state{device_type="H3-10.0-E",inverter="SN1",product_type="H3",state="fault",station_name="Home"} 0
+foxess_device_state{device_type="H3-10.0-E",inverter="SN1",product_type="H3",state="offline",station_name="Home"} 0
+foxess_device_state{device_type="H3-10.0-E",inverter="SN1",product_type="H3",state="online",station_name="Home"} 1
+foxess_device_state{device_type="H3-10.0-E",inverter="SN1",product_type="H3",state="unknown",station_name="Home"} 0
+# HELP foxess_device_state_seconds_total Time the inverter has spent in the state.
+# TYPE foxess_device_state_seconds_total counter
+foxess_device_state_seconds_total{inverter="SN1",state="fault"} 600
+foxess_device_state_seconds_total{inverter="SN1",state="offline"} 0
+foxess_device_state_seconds_total{inverter="SN1",state="online"} 3900
+foxess_device_state_seconds_total{inverter="SN1",state="unknown"} 0
+# HELP foxess_device_state_transitions_total Number of times the inverter changed state.
+# TYPE foxess_device_state_transitions_total counter
+foxess_device_state_transitions_total{from="fault",inverter="SN1",to="online"} 1
+foxess_device_state_transitions_total{from="online",inverter="SN1",to="fault"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected),
+		"foxess_device_state", "foxess_device_state_seconds_total", "foxess_device_state_transitions_total"))
+
+	subject.UpdateStatus(nil, includeAll)
+	require.Equal(t, 0, testutil.CollectAndCount(subject.Registry, "foxess_device_state"))
+}
@@ -0,0 +1,163 @@
+package serve_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestPowerIsIntegratedIntoEnergy(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1700000000, 0)
+	subject := serve.NewMetrics()
+	subject.ConfigureIntegration([]string{"pvPower"}, 15*time.Minute)
+
+	for _, sample := range []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{0, 2},
+		{6 * time.Minute, 4},            // 0.3kWh
+		{6 * time.Minute, 4},            // Unchanged data is not integrated again.
+		{12 * time.Minute, 2},           // 0.3kWh
+		{time.Hour, 10},                 // Too long a gap to integrate across.
+		{time.Hour + 3*time.Minute, -1}, // Negative power counts as zero, so 0.25kWh.
+	} {
+		subject.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start.Add(sample.offset), "kW", map[string]float64{"pvPower": sample.value, "SoC": 50})})
+	}
+
+	assert.InDelta(t, 0.85, counterValue(t, subject.Registry, "foxess_integrated_energy_kwh_total"), 1e-9)
+	assert.InDelta(t, 0.85*3.6e6, counterValue(t, subject.Registry, "foxess_integrated_energy_joules_total"), 1e-3)
+}
+
+func TestPowerIsIntegratedByUnit(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1700000000, 0)
+	subject := serve.NewMetrics()
+	subject.ConfigureIntegration([]string{"pvPower"}, 15*time.Minute)
+
+	subject.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start, "W", map[string]float64{"pvPower": 2000})})
+	subject.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start.Add(6*time.Minute), "W", map[string]float64{"pvPower": 4000})})
+	assert.InDelta(t, 0.3, counterValue(t, subject.Registry, "foxess_integrated_energy_kwh_total"), 1e-9, "W is converted to kW")
+
+	subject.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start.Add(12*time.Minute), "%", map[string]float64{"pvPower": 4000})})
+	subject.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start.Add(18*time.Minute), "", map[string]float64{"pvPower": 4000})})
+	assert.InDelta(t, 0.3, counterValue(t, subject.Registry, "foxess_integrated_energy_kwh_total"), 1e-9, "other units are not power")
+}
+
+// powerData is real-time data with every variable reported in the given unit.
+func powerData(inverter string, at time.Time, unit string, values map[string]float64) foxess.RealTimeData {
+	data := realTimeData(inverter, at, values)
+	for i := range data.Variables {
+		data.Variables[i].Unit = unit
+	}
+
+	return data
+}
+
+func counterValue(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() == name {
+			require.Len(t, family.GetMetric(), 1)
+
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+
+	require.Fail(t, "metric not found", name)
+
+	return 0
+}
+
+func TestEnergyIsPersisted(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "state.json")
+	start := time.Unix(1700000000, 0)
+
+	state, err := serve.LoadState(fileName)
+	require.NoError(t, err, "a missing state file is empty")
+	assert.Empty(t, state.Energy)
+
+	first := serve.NewMetrics()
+	first.ConfigureIntegration([]string{"pvPower"}, 15*time.Minute)
+	first.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start, "kW", map[string]float64{"pvPower": 1})})
+	first.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start.Add(6*time.Minute), "kW", map[string]float64{"pvPower": 1})})
+	require.NoError(t, first.Snapshot().Save(fileName))
+
+	state, err = serve.LoadState(fileName)
+	require.NoError(t, err)
+
+	second := serve.NewMetrics()
+	second.ConfigureIntegration([]string{"pvPower"}, 15*time.Minute)
+	second.Restore(state, func(string) bool { return true })
+	second.UpdateRealTime([]foxess.RealTimeData{powerData("SN1", start.Add(12*time.Minute), "kW", map[string]float64{"pvPower": 1})})
+
+	assert.InDelta(t, 0.2, counterValue(t, second.Registry, "foxess_integrated_energy_kwh_total"), 1e-9)
+}
+
+func TestRealTimeDataAndDevicesAreRestored(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	first := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+	first.UpdateStatus([]foxess.Device{{DeviceSerialNumber: "SN1", Status: foxess.StatusOnline}}, func(string) bool { return true }) //nolint:exhaustruct
+	first.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", now, map[string]float64{"pvPower": 2, "feedinPower": 1})})
+
+	fileName := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, first.Snapshot().Save(fileName))
+
+	state, err := serve.LoadState(fileName)
+	require.NoError(t, err)
+
+	second := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+	second.Restore(state, func(string) bool { return true })
+
+	for _, name := range []string{"foxess_realtime_data", "foxess_device_status", "foxess_realtime_data_timestamp_seconds", "foxess_derived_data"} {
+		expected, err := testutil.GatherAndCount(first.Registry, name)
+		require.NoError(t, err)
+
+		actual, err := testutil.GatherAndCount(second.Registry, name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, name)
+		assert.Positive(t, actual, name)
+	}
+}
+
+func TestOnlyIncludedInvertersAreRestored(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	first := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+	first.UpdateStatus([]foxess.Device{
+		{DeviceSerialNumber: "SN1", Status: foxess.StatusOnline}, //nolint:exhaustruct
+		{DeviceSerialNumber: "SN2", Status: foxess.StatusOnline}, //nolint:exhaustruct
+	}, func(string) bool { return true })
+	first.UpdateRealTime([]foxess.RealTimeData{
+		realTimeData("SN1", now, map[string]float64{"pvPower": 2}),
+		realTimeData("SN2", now, map[string]float64{"pvPower": 3}),
+	})
+
+	second := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+	second.Restore(first.Snapshot(), func(inverter string) bool { return inverter == "SN1" })
+
+	for _, name := range []string{"foxess_realtime_data", "foxess_device_status"} {
+		count, err := testutil.GatherAndCount(second.Registry, name)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count, name)
+	}
+}
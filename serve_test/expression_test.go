@@ -0,0 +1,58 @@
+package serve_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestExpressionEvaluation(t *testing.T) {
+	t.Parallel()
+
+	values := map[string]float64{"a": 6, "b": 2, "zero": 0}
+
+	for source, expected := range map[string]float64{
+		"a + b * 3":        12,
+		"(a + b) * 3":      24,
+		"a / b - -1":       4,
+		"-a + 10":          4,
+		"max(a, b, 7) / 2": 3.5,
+		"min(a, b)":        2,
+		"abs(b - a)":       4,
+		"1.5 * b":          3,
+		" a-b ":            4,
+		"1 - b / a * 3":    0,
+	} {
+		expression, err := serve.ParseExpression(source)
+		require.NoError(t, err, source)
+
+		actual, ok := expression.Evaluate(values)
+		assert.True(t, ok, source)
+		assert.InDelta(t, expected, actual, 1e-9, source)
+	}
+}
+
+func TestExpressionUndefinedResults(t *testing.T) {
+	t.Parallel()
+
+	expression, err := serve.ParseExpression("a / zero")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "zero"}, expression.Variables())
+
+	_, ok := expression.Evaluate(map[string]float64{"a": 1, "zero": 0})
+	assert.False(t, ok, "division by zero")
+
+	_, ok = expression.Evaluate(map[string]float64{"a": 1})
+	assert.False(t, ok, "missing variable")
+}
+
+func TestInvalidExpressions(t *testing.T) {
+	t.Parallel()
+
+	for _, source := range []string{"", "a +", "(a", "a b", "sqrt(a)", "abs(a, b)", "a $ b", "1..2", "min()", "1e5"} {
+		_, err := serve.ParseExpression(source)
+		require.ErrorIs(t, err, serve.ErrInvalidExpression, source)
+	}
+}
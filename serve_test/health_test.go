@@ -0,0 +1,98 @@
+package serve_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func readiness(t *testing.T, subject *serve.Health) (int, *serve.HealthResponse) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	subject.Readiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	response := &serve.HealthResponse{} //nolint:exhaustruct
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(response))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	return recorder.Code, response
+}
+
+func TestLiveness(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewHealth(serve.NewDeviceCache(), serve.NewAPIQuota(), func() time.Duration { return time.Minute })
+	recorder := httptest.NewRecorder()
+	subject.Liveness(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, recorder.Body.String())
+}
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+
+	devices := serve.NewDeviceCache()
+	quota := serve.NewAPIQuota()
+	subject := serve.NewHealth(devices, quota, func() time.Duration { return 3 * time.Minute })
+
+	code, response := readiness(t, subject)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, serve.StatusNotReady, response.Status)
+	assert.Equal(t, map[string]serve.Check{
+		"devices":  {OK: false, Detail: "device list not loaded"},
+		"quota":    {OK: false, Detail: "API quota unknown"},
+		"realtime": {OK: false, Detail: "no real-time data polled yet"},
+	}, response.Checks)
+
+	devices.Set([]string{"a", "b"})
+	quota.Set(&foxess.APIUsage{Total: 1440, Remaining: 1000, PercentageUsed: 30.6})
+	subject.RealTimePolled(time.Now().Add(-time.Hour))
+
+	code, response = readiness(t, subject)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, serve.Check{OK: true, Detail: "2 devices"}, response.Checks["devices"])
+	assert.Equal(t, serve.Check{OK: true, Detail: "1000/1440 remaining"}, response.Checks["quota"])
+	assert.Equal(t, serve.Check{OK: false, Detail: "last polled 1h0m0s ago, more than 3m0s"}, response.Checks["realtime"])
+
+	subject.RealTimePolled(time.Now())
+
+	code, response = readiness(t, subject)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, serve.StatusReady, response.Status)
+	assert.True(t, response.Checks["realtime"].OK)
+}
+
+func TestReadinessOnScrape(t *testing.T) {
+	t.Parallel()
+
+	devices := serve.NewDeviceCache()
+	quota := serve.NewAPIQuota()
+	subject := serve.NewHealth(devices, quota, func() time.Duration { return 3 * time.Minute })
+	subject.FetchOnScrape()
+
+	code, response := readiness(t, subject)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, serve.Check{OK: true, Detail: "fetched on scrape, none yet"}, response.Checks["realtime"])
+
+	devices.Set([]string{"a"})
+	quota.Set(&foxess.APIUsage{Total: 1440, Remaining: 1000, PercentageUsed: 30.6})
+
+	code, response = readiness(t, subject)
+	assert.Equal(t, http.StatusOK, code, "ready to be scraped before anything has been fetched")
+	assert.Equal(t, serve.StatusReady, response.Status)
+
+	subject.RealTimePolled(time.Now().Add(-time.Hour))
+
+	code, response = readiness(t, subject)
+	assert.Equal(t, http.StatusOK, code, "scrapes, not the exporter, decide how often data is fetched")
+	assert.Equal(t, serve.Check{OK: true, Detail: "fetched on scrape, last 1h0m0s ago"}, response.Checks["realtime"])
+}
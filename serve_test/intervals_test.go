@@ -0,0 +1,88 @@
+package serve_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestIntervalsAreFixedWhenNotAdaptive(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewIntervals(3*time.Minute, 15*time.Minute, time.Minute, false)
+	subject.Recalculate(1, time.Hour, 1)
+
+	assert.Equal(t, 3*time.Minute, subject.RealTime())
+	assert.Equal(t, 15*time.Minute, subject.Status())
+}
+
+func TestIntervalsSlowDownWhenQuotaIsTight(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewIntervals(3*time.Minute, 15*time.Minute, time.Minute, true)
+	// Over 10 hours the configured intervals need 200 + 40 calls, and quota checks another 60.
+	subject.Recalculate(200, 10*time.Hour, 1)
+
+	assert.Equal(t, 6*time.Minute, subject.RealTime())
+	assert.Equal(t, 30*time.Minute, subject.Status())
+}
+
+func TestIntervalsSpeedUpToFloorWhenQuotaIsPlentiful(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewIntervals(3*time.Minute, 15*time.Minute, time.Minute, true)
+	subject.Recalculate(1000, time.Hour, 1)
+
+	assert.Equal(t, time.Minute, subject.RealTime())
+	assert.Equal(t, time.Minute, subject.Status())
+}
+
+func TestIntervalsAccountForBatches(t *testing.T) {
+	t.Parallel()
+
+	single := serve.NewIntervals(3*time.Minute, 15*time.Minute, time.Minute, true)
+	single.Recalculate(500, 10*time.Hour, 1)
+
+	multiple := serve.NewIntervals(3*time.Minute, 15*time.Minute, time.Minute, true)
+	multiple.Recalculate(500, 10*time.Hour, 3)
+
+	assert.Greater(t, multiple.RealTime(), single.RealTime())
+}
+
+func TestIntervalsWaitForTheResetWhenQuotaIsExhausted(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewIntervals(3*time.Minute, 15*time.Minute, time.Minute, true)
+	subject.Recalculate(0, time.Hour, 1)
+
+	assert.Equal(t, time.Hour, subject.RealTime())
+	assert.Equal(t, time.Hour, subject.Status())
+
+	subject.Recalculate(0, 48*time.Hour, 1)
+	assert.Equal(t, 24*time.Hour, subject.RealTime())
+}
+
+func TestIntervalsSignalChanges(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewIntervals(3*time.Minute, 15*time.Minute, time.Minute, true)
+	changed := subject.Changed()
+
+	subject.Recalculate(200, 10*time.Hour, 1)
+	assert.True(t, isClosed(changed))
+
+	changed = subject.Changed()
+	subject.Recalculate(200, 10*time.Hour, 1)
+	assert.False(t, isClosed(changed), "unchanged intervals are not signalled")
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,142 @@
+package serve_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	fileName := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(fileName, []byte(contents), 0o600))
+
+	return fileName
+}
+
+func TestLoadMappingsOverridesDefaults(t *testing.T) {
+	t.Parallel()
+
+	fileName := writeFile(t, "mappings.yaml", `
+pvPower:
+  name: foxess_solar_watts
+  unit: watts
+  scale: 1000
+SoC:
+  name: ""
+meterPower:
+  name: foxess_meter_power_watts
+  scale: 1000
+`)
+
+	mappings, err := serve.LoadMappings(fileName)
+	require.NoError(t, err)
+	assert.Equal(t, "foxess_solar_watts", mappings["pvPower"].Name)
+	assert.Equal(t, serve.MetricTypeGauge, mappings["meterPower"].Type)
+	assert.NotContains(t, mappings, "SoC")
+	assert.Equal(t, serve.DefaultMappings()["generation"], mappings["generation"])
+}
+
+func TestLoadMappingsRejectsInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, contents := range map[string]string{
+		"name":      "pvPower:\n  name: not-valid\n",
+		"type":      "pvPower:\n  name: foxess_pv\n  type: histogram\n",
+		"duplicate": "meterPower:\n  name: foxess_pv_power_watts\n",
+		"builtin":   "meterPower:\n  name: foxess_device_status\n",
+		"runtime":   "meterPower:\n  name: go_goroutines\n",
+		"quota":     "meterPower:\n  name: foxess_api_quota_total\n",
+		"scrapes":   "meterPower:\n  name: foxess_scrapes_total\n",
+		"histogram": "meterPower:\n  name: foxess_api_request_duration_seconds_bucket\n",
+	} {
+		_, err := serve.LoadMappings(writeFile(t, name+".yaml", contents))
+		require.ErrorIs(t, err, serve.ErrInvalidMapping, name)
+	}
+}
+
+func TestMappedMetricsAreExported(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics(serve.WithMappings(serve.DefaultMappings()), serve.WithoutGenericMetric())
+	subject.UpdateRealTime([]foxess.RealTimeData{withUnits(realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 1.5, "generation": 2, "unmapped": 3}),
+		map[string]string{"pvPower": "kW", "generation": "kWh"})})
+
+	expected := `
+# HELP foxess_generation_joules_total Cumulative energy generated. Measured in joules.
+# TYPE foxess_generation_joules_total counter
+foxess_generation_joules_total{inverter="SN1"} 7.2e+06
+# HELP foxess_pv_power_watts PV power. Measured in watts.
+# TYPE foxess_pv_power_watts gauge
+foxess_pv_power_watts{inverter="SN1"} 1500
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_generation_joules_total", "foxess_pv_power_watts"))
+}
+
+func TestMappedMetricsAreScaledByReportedUnit(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics(serve.WithMappings(serve.DefaultMappings()), serve.WithoutGenericMetric())
+	subject.UpdateRealTime([]foxess.RealTimeData{
+		withUnits(realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 1500, "generation": 2000, "loadsPower": 1}),
+			map[string]string{"pvPower": "W", "generation": "Wh", "loadsPower": "A"}),
+	})
+
+	expected := `
+# HELP foxess_generation_joules_total Cumulative energy generated. Measured in joules.
+# TYPE foxess_generation_joules_total counter
+foxess_generation_joules_total{inverter="SN1"} 7.2e+06
+# HELP foxess_pv_power_watts PV power. Measured in watts.
+# TYPE foxess_pv_power_watts gauge
+foxess_pv_power_watts{inverter="SN1"} 1500
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected),
+		"foxess_generation_joules_total", "foxess_pv_power_watts", "foxess_load_power_watts"), "a unit that cannot be converted is not exported")
+}
+
+func TestGenericMetricIsExported(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics()
+	subject.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 1.5})})
+
+	expected := `
+# HELP foxess_realtime_data Data from the FoxESS platform.
+# TYPE foxess_realtime_data gauge
+foxess_realtime_data{inverter="SN1",variable="pvPower"} 1.5
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_realtime_data"))
+}
+
+func realTimeData(inverter string, at time.Time, values map[string]float64) foxess.RealTimeData {
+	data := foxess.RealTimeData{DeviceSN: inverter, Time: foxess.CustomTime{Time: at}} //nolint:exhaustruct
+
+	for variable, value := range values {
+		data.Variables = append(data.Variables, foxess.RealTimeVariable{
+			Variable: variable,
+			Unit:     "",
+			Name:     "",
+			Value:    foxess.NumberAsNil{Number: value},
+		})
+	}
+
+	return data
+}
+
+// withUnits sets the unit FoxESS reported each variable in.
+func withUnits(data foxess.RealTimeData, units map[string]string) foxess.RealTimeData {
+	for i := range data.Variables {
+		data.Variables[i].Unit = units[data.Variables[i].Variable]
+	}
+
+	return data
+}
@@ -0,0 +1,85 @@
+package serve_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+var errNetwork = errors.New("network unreachable")
+
+func TestRealTimePollIsAttributedToInverters(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics()
+	now := time.Unix(1700000000, 0)
+	err := errors.Join(
+		&foxess.BatchError{SerialNumbers: []string{"bad"}, Err: &foxess.ResponseError{ErrorNumber: 41930, Message: "device not found"}},
+		&foxess.BatchError{SerialNumbers: []string{"unreachable"}, Err: errNetwork},
+	)
+
+	subject.RecordRealTimePoll([]string{"good", "bad", "unreachable", "absent"}, []foxess.RealTimeData{{DeviceSN: "good"}}, err, now) //nolint:exhaustruct
+
+	expected := `
+# HELP foxess_last_successful_poll_timestamp_seconds Time data was last successfully retrieved for an inverter.
+# TYPE foxess_last_successful_poll_timestamp_seconds gauge
+foxess_last_successful_poll_timestamp_seconds{inverter="good",job="realtime"} 1.7e+09
+# HELP foxess_poll_errors_total Number of failures retrieving data for an inverter.
+# TYPE foxess_poll_errors_total counter
+foxess_poll_errors_total{code="41930",inverter="bad",job="realtime"} 1
+foxess_poll_errors_total{code="missing",inverter="absent",job="realtime"} 1
+foxess_poll_errors_total{code="request",inverter="unreachable",job="realtime"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected),
+		"foxess_last_successful_poll_timestamp_seconds", "foxess_poll_errors_total"))
+}
+
+func TestRealTimePollFailureWithoutBatches(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics()
+	subject.RecordRealTimePoll([]string{"1"}, nil, errNetwork, time.Now())
+
+	expected := `
+# HELP foxess_poll_errors_total Number of failures retrieving data for an inverter.
+# TYPE foxess_poll_errors_total counter
+foxess_poll_errors_total{code="request",inverter="1",job="realtime"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_poll_errors_total"))
+}
+
+func TestRequestsAreInstrumented(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics()
+	subject.ObserveRequest(&foxess.RequestEvent{
+		Method: "POST", Path: "/op/v1/device/real/query", Outcome: foxess.OutcomeSuccess, ErrorNumber: 0, ResponseSize: 512, Duration: time.Second, Err: nil,
+	})
+	subject.ObserveRequest(&foxess.RequestEvent{
+		Method: "POST", Path: "/op/v1/device/real/query", Outcome: foxess.OutcomeParseFailure, ErrorNumber: 0, ResponseSize: 6, Duration: time.Second, Err: errNetwork,
+	})
+	subject.ObserveRequest(&foxess.RequestEvent{
+		Method: "GET", Path: "/op/v0/user/getAccessCount", Outcome: foxess.OutcomeRequestFailure, ErrorNumber: 0, ResponseSize: 0, Duration: time.Second, Err: errNetwork,
+	})
+
+	expected := `
+# HELP foxess_api_parse_failures_total Number of FoxESS API responses that could not be parsed.
+# TYPE foxess_api_parse_failures_total counter
+foxess_api_parse_failures_total{endpoint="/op/v1/device/real/query"} 1
+# HELP foxess_api_requests_total Number of requests made to the FoxESS API.
+# TYPE foxess_api_requests_total counter
+foxess_api_requests_total{endpoint="/op/v0/user/getAccessCount",errno="",outcome="request_failure"} 1
+foxess_api_requests_total{endpoint="/op/v1/device/real/query",errno="",outcome="parse_failure"} 1
+foxess_api_requests_total{endpoint="/op/v1/device/real/query",errno="0",outcome="success"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_api_requests_total", "foxess_api_parse_failures_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(subject.Registry, "foxess_api_response_size_bytes"))
+	require.Equal(t, 2, testutil.CollectAndCount(subject.Registry, "foxess_api_request_duration_seconds"))
+	require.Positive(t, testutil.CollectAndCount(subject.Registry, "go_goroutines"))
+}
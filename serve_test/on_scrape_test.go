@@ -0,0 +1,88 @@
+package serve_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestOnScrapeCachesUntilTheTTL(t *testing.T) {
+	t.Parallel()
+
+	var fetches atomic.Int32
+
+	ttl := time.Hour
+	subject := serve.NewOnScrape(func() time.Duration { return ttl }, func() bool { return true }, func() { fetches.Add(1) }, time.Time{})
+
+	assert.Equal(t, serve.ScrapeFetched, subject.Refresh())
+	assert.Equal(t, serve.ScrapeCached, subject.Refresh())
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestOnScrapeRespectsTheRestoredFetchTime(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewOnScrape(func() time.Duration { return time.Hour }, func() bool { return true }, func() {}, time.Now())
+
+	assert.Equal(t, serve.ScrapeCached, subject.Refresh())
+}
+
+func TestOnScrapeIsThrottledByTheQuota(t *testing.T) {
+	t.Parallel()
+
+	var fetches atomic.Int32
+
+	subject := serve.NewOnScrape(func() time.Duration { return 0 }, func() bool { return false }, func() { fetches.Add(1) }, time.Time{})
+
+	assert.Equal(t, serve.ScrapeThrottled, subject.Refresh())
+	assert.Zero(t, fetches.Load())
+}
+
+func TestOnScrapeCoalescesConcurrentScrapes(t *testing.T) {
+	t.Parallel()
+
+	var (
+		fetches atomic.Int32
+		wg      sync.WaitGroup
+	)
+
+	release := make(chan struct{})
+	subject := serve.NewOnScrape(func() time.Duration { return time.Hour }, func() bool { return true }, func() {
+		fetches.Add(1)
+		<-release
+	}, time.Time{})
+
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			subject.Refresh()
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestFetchOnScrapeRefreshesBeforeCollecting(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics()
+	subject.FetchOnScrape(serve.NewOnScrape(func() time.Duration { return time.Hour }, func() bool { return true }, func() {
+		subject.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 1})})
+	}, time.Time{}))
+
+	assert.Equal(t, 1, testutil.CollectAndCount(subject.Registry, "foxess_realtime_data"))
+	// The first scrape fetched, the second was served from the cache.
+	assert.Equal(t, 2, testutil.CollectAndCount(subject.Registry, "foxess_scrapes_total"))
+}
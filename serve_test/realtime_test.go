@@ -0,0 +1,130 @@
+package serve_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestSamplesUseDataTimestamps(t *testing.T) {
+	t.Parallel()
+
+	dataTime := time.UnixMilli(1700000000000)
+	now := dataTime.Add(5 * time.Minute)
+
+	subject := serve.NewMetrics(serve.WithDataTimestamps(), serve.WithClock(func() time.Time { return now }))
+	subject.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", dataTime, map[string]float64{"pvPower": 1.5})})
+
+	expected := `
+# HELP foxess_realtime_data Data from the FoxESS platform.
+# TYPE foxess_realtime_data gauge
+foxess_realtime_data{inverter="SN1",variable="pvPower"} 1.5 1700000000000
+# HELP foxess_realtime_data_age_seconds Age of the latest real-time data when scraped.
+# TYPE foxess_realtime_data_age_seconds gauge
+foxess_realtime_data_age_seconds{inverter="SN1"} 300
+# HELP foxess_realtime_data_timestamp_seconds Time FoxESS recorded the latest real-time data.
+# TYPE foxess_realtime_data_timestamp_seconds gauge
+foxess_realtime_data_timestamp_seconds{inverter="SN1"} 1.7e+09
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected),
+		"foxess_realtime_data", "foxess_realtime_data_age_seconds", "foxess_realtime_data_timestamp_seconds"))
+}
+
+func TestStaleSeriesAreRemoved(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	subject := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+
+	subject.UpdateRealTime([]foxess.RealTimeData{
+		realTimeData("SN1", now, map[string]float64{"pvPower": 1, "SoC": 50}),
+		realTimeData("SN2", now, map[string]float64{"pvPower": 2}),
+	})
+
+	// SN1 stops reporting SoC, and SN2 disappears altogether.
+	now = now.Add(10 * time.Minute)
+	subject.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", now, map[string]float64{"pvPower": 3})})
+	subject.RemoveStale(5 * time.Minute)
+
+	expected := `
+# HELP foxess_realtime_data Data from the FoxESS platform.
+# TYPE foxess_realtime_data gauge
+foxess_realtime_data{inverter="SN1",variable="pvPower"} 3
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_realtime_data"))
+	require.Equal(t, 1, testutil.CollectAndCount(subject.Registry, "foxess_realtime_data_timestamp_seconds"))
+}
+
+func TestUnchangedDataIsNotStale(t *testing.T) {
+	t.Parallel()
+
+	dataTime := time.Unix(1700000000, 0)
+	now := dataTime
+	subject := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+
+	subject.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", dataTime, map[string]float64{"pvPower": 1})})
+
+	now = now.Add(10 * time.Minute)
+	subject.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", dataTime, map[string]float64{"pvPower": 1})})
+	subject.RemoveStale(5 * time.Minute)
+
+	require.Equal(t, 1, testutil.CollectAndCount(subject.Registry, "foxess_realtime_data"))
+}
+
+func TestStatusOfRemovedDevicesIsDropped(t *testing.T) {
+	t.Parallel()
+
+	subject := serve.NewMetrics()
+	includeAll := func(string) bool { return true }
+
+	subject.UpdateStatus([]foxess.Device{{DeviceSerialNumber: "SN1", Status: foxess.StatusOnline}, {DeviceSerialNumber: "SN2", Status: foxess.StatusFault}}, includeAll) //nolint:exhaustruct
+	subject.PollSucceeded(serve.JobStatus, "SN2", time.Now())
+	subject.UpdateStatus([]foxess.Device{{DeviceSerialNumber: "SN1", Status: foxess.StatusOffline}}, includeAll) //nolint:exhaustruct
+
+	expected := `
+# HELP foxess_device_status Status of the inverter.
+# TYPE foxess_device_status gauge
+foxess_device_status{inverter="SN1"} 3
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_device_status"))
+	require.Equal(t, 0, testutil.CollectAndCount(subject.Registry, "foxess_last_successful_poll_timestamp_seconds"))
+}
+
+func TestDerivedEnergyFlows(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	subject := serve.NewMetrics(serve.WithClock(func() time.Time { return now }))
+
+	derivations, err := serve.ParseDerivations(map[string]string{"gridNet": "", "pvShare": "pvPower / houseLoadPower"})
+	require.NoError(t, err)
+	subject.ConfigureDerived(derivations)
+
+	subject.UpdateRealTime([]foxess.RealTimeData{realTimeData("SN1", now, map[string]float64{
+		"pvPower":              4,
+		"gridConsumptionPower": 0.5,
+		"feedinPower":          1,
+		"batChargePower":       1.5,
+		"batDischargePower":    0,
+		"loadsPower":           2,
+	})})
+
+	expected := `
+# HELP foxess_derived_data Energy flows derived from the FoxESS data.
+# TYPE foxess_derived_data gauge
+foxess_derived_data{inverter="SN1",variable="batteryNet"} -1.5
+foxess_derived_data{inverter="SN1",variable="houseLoad"} 2
+foxess_derived_data{inverter="SN1",variable="selfConsumption"} 0.75
+foxess_derived_data{inverter="SN1",variable="selfSufficiency"} 0.75
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_derived_data"))
+
+	now = now.Add(time.Hour)
+	subject.RemoveStale(time.Minute)
+	require.Equal(t, 0, testutil.CollectAndCount(subject.Registry, "foxess_derived_data"))
+}
@@ -0,0 +1,51 @@
+package serve_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/serve"
+)
+
+func TestStationAggregates(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	subject := serve.NewMetrics()
+	subject.ConfigureStations(serve.DefaultAggregations().Merge(serve.Aggregations{"loadsPower": serve.AggregationMax}), map[string]float64{"SN2": 30})
+	subject.UpdateStatus([]foxess.Device{
+		{DeviceSerialNumber: "SN1", StationID: "S1", StationName: "Home"}, //nolint:exhaustruct
+		{DeviceSerialNumber: "SN2", StationID: "S1", StationName: "Home"}, //nolint:exhaustruct
+		{DeviceSerialNumber: "SN3", StationID: "S2", StationName: "Shed"}, //nolint:exhaustruct
+		{DeviceSerialNumber: "SN4"},                                       //nolint:exhaustruct
+	}, func(string) bool { return true })
+	subject.UpdateRealTime([]foxess.RealTimeData{
+		// SN1's capacity of 10 is derived from its residual energy and state of charge.
+		realTimeData("SN1", now, map[string]float64{"pvPower": 2, "SoC": 50, "ResidualEnergy": 5, "loadsPower": 1}),
+		realTimeData("SN2", now, map[string]float64{"pvPower": 3, "SoC": 100, "loadsPower": 4}),
+		realTimeData("SN3", now, map[string]float64{"pvPower": 1, "SoC": 20}),
+		realTimeData("SN4", now, map[string]float64{"pvPower": 8}),
+	})
+
+	expected := `
+# HELP foxess_station_realtime_data Data from the FoxESS platform, aggregated across the inverters of a station.
+# TYPE foxess_station_realtime_data gauge
+foxess_station_realtime_data{station_id="S1",station_name="Home",variable="SoC"} 87.5
+foxess_station_realtime_data{station_id="S1",station_name="Home",variable="loadsPower"} 4
+foxess_station_realtime_data{station_id="S1",station_name="Home",variable="pvPower"} 5
+foxess_station_realtime_data{station_id="S2",station_name="Shed",variable="SoC"} 20
+foxess_station_realtime_data{station_id="S2",station_name="Shed",variable="pvPower"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(subject.Registry, strings.NewReader(expected), "foxess_station_realtime_data"))
+}
+
+func TestAggregationsAreValidated(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, serve.DefaultAggregations().Validate())
+	require.ErrorIs(t, serve.Aggregations{"pvPower": "median"}.Validate(), serve.ErrInvalidAggregation)
+}
@@ -0,0 +1,283 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+const (
+	// LayoutFields writes one measurement per inverter update, with a field per variable.
+	LayoutFields = "fields"
+	// LayoutMeasurements writes a measurement per variable, with a single value field.
+	LayoutMeasurements = "measurements"
+)
+
+// InfluxDBConfig configures writing real-time data to InfluxDB as line protocol.
+type InfluxDBConfig struct {
+	URL             string `long:"url"              description:"InfluxDB base URL, enabling the sink"    env:"URL"                                                             yaml:"url"`
+	APIVersion      int    `long:"api-version"      description:"Write API version"                                      default:"2" choice:"1" choice:"2"                      yaml:"api-version"`
+	Database        string `long:"database"         description:"Database to write to (v1)"               env:"DATABASE"                                                        yaml:"database"`
+	RetentionPolicy string `long:"retention-policy" description:"Retention policy to write to (v1)"                                                                             yaml:"retention-policy"`
+	Organisation    string `long:"org"              description:"Organisation to write to (v2)"           env:"ORG"                                                             yaml:"org"`
+	Bucket          string `long:"bucket"           description:"Bucket to write to (v2)"                 env:"BUCKET"                                                          yaml:"bucket"`
+	Token           string `long:"token"            description:"API token"                               env:"TOKEN"                                                           yaml:"token"`
+	Layout          string `long:"layout"           description:"Variables as fields or measurements"                    default:"fields" choice:"fields" choice:"measurements" yaml:"layout"`
+	Measurement     string `long:"measurement"      description:"Measurement name with the fields layout"                default:"foxess_realtime"                              yaml:"measurement"`
+	BatchSize       int    `long:"batch-size"       description:"Most lines to send in each request"                     default:"5000"                                         yaml:"batch-size"`
+	Gzip            bool   `long:"gzip"             description:"Compress requests with gzip"                                                                                   yaml:"gzip"`
+	HTTPConfig      `yaml:",inline"`
+	QueueConfig     `yaml:",inline"`
+}
+
+// InfluxDB writes each new real-time sample as line protocol, tagged with the inverter and its station.
+type InfluxDB struct {
+	config   *InfluxDBConfig
+	endpoint string
+	client   *http.Client
+	delivery *delivery
+	latest   *latest
+	mutex    sync.RWMutex
+	stations map[string]foxess.Device
+}
+
+func NewInfluxDB(config *InfluxDBConfig) (*InfluxDB, error) {
+	endpoint, err := config.endpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := config.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	x := &InfluxDB{
+		config:   config,
+		endpoint: endpoint,
+		client:   client,
+		delivery: nil,
+		latest:   newLatest(),
+		mutex:    sync.RWMutex{},
+		stations: make(map[string]foxess.Device),
+	}
+
+	if x.delivery, err = newDelivery("InfluxDB", &config.QueueConfig, x.post); err != nil {
+		return nil, err
+	}
+
+	return x, nil
+}
+
+func (c *InfluxDBConfig) validate() error {
+	switch {
+	case c.APIVersion == 1 && c.Database == "":
+		return fmt.Errorf("%w: InfluxDB v1 requires a database", ErrInvalidConfig)
+	case c.APIVersion == 2 && (c.Organisation == "" || c.Bucket == ""):
+		return fmt.Errorf("%w: InfluxDB v2 requires an organisation and bucket", ErrInvalidConfig)
+	case c.Layout != LayoutFields && c.Layout != LayoutMeasurements:
+		return fmt.Errorf("%w: unknown InfluxDB layout '%s'", ErrInvalidConfig, c.Layout)
+	case c.Layout == LayoutFields && c.Measurement == "":
+		return fmt.Errorf("%w: InfluxDB fields layout requires a measurement", ErrInvalidConfig)
+	case c.BatchSize <= 0:
+		return fmt.Errorf("%w: InfluxDB batch size must be positive", ErrInvalidConfig)
+	}
+
+	return c.QueueConfig.validate()
+}
+
+// endpoint is the write URL for the API version, writing with millisecond precision.
+func (c *InfluxDBConfig) endpoint() (string, error) {
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid InfluxDB URL: %w", ErrInvalidConfig, err)
+	}
+
+	query := url.Values{"precision": []string{"ms"}}
+
+	switch c.APIVersion {
+	case 1:
+		base = base.JoinPath("write")
+		query.Set("db", c.Database)
+
+		if c.RetentionPolicy != "" {
+			query.Set("rp", c.RetentionPolicy)
+		}
+	case 2:
+		base = base.JoinPath("api", "v2", "write")
+		query.Set("org", c.Organisation)
+		query.Set("bucket", c.Bucket)
+	default:
+		return "", fmt.Errorf("%w: unknown InfluxDB API version %d", ErrInvalidConfig, c.APIVersion)
+	}
+
+	base.RawQuery = query.Encode()
+
+	return base.String(), nil
+}
+
+// WriteDevices records the station of each inverter, to tag its data with.
+func (x *InfluxDB) WriteDevices(devices []foxess.Device) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for _, device := range devices {
+		x.stations[device.DeviceSerialNumber] = device
+	}
+
+	return nil
+}
+
+// Write queues the samples FoxESS has recorded since the last write, in batches.
+func (x *InfluxDB) Write(data []foxess.RealTimeData) error {
+	lines := x.lines(x.latest.fresh(data))
+
+	for batch := range slices.Chunk(lines, x.config.BatchSize) {
+		payload, err := x.encode(batch)
+		if err != nil {
+			return err
+		}
+
+		if err := x.delivery.enqueue(payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *InfluxDB) Close(ctx context.Context) error {
+	return x.delivery.close(ctx)
+}
+
+func (x *InfluxDB) lines(data []foxess.RealTimeData) []string {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	var lines []string
+
+	for _, result := range data {
+		tags := x.tags(result.DeviceSN)
+		timestamp := strconv.FormatInt(result.Time.UnixMilli(), 10)
+
+		var fields []string
+
+		for _, variable := range result.Variables {
+			// Line protocol has no representation of NaN or infinity.
+			if math.IsNaN(variable.Value.Number) || math.IsInf(variable.Value.Number, 0) {
+				continue
+			}
+
+			if x.config.Layout == LayoutMeasurements {
+				lines = append(lines, escapeMeasurement(variable.Variable)+tags+" value="+formatFloat(variable.Value.Number)+" "+timestamp)
+			} else {
+				fields = append(fields, escapeKey(variable.Variable)+"="+formatFloat(variable.Value.Number))
+			}
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		lines = append(lines, escapeMeasurement(x.config.Measurement)+tags+" "+strings.Join(fields, ",")+" "+timestamp)
+	}
+
+	return lines
+}
+
+// tags is the inverter's tag set, sorted by key as InfluxDB prefers.
+func (x *InfluxDB) tags(inverter string) string {
+	tags := ",inverter=" + escapeKey(inverter)
+
+	if device, ok := x.stations[inverter]; ok {
+		if device.StationID != "" {
+			tags += ",station_id=" + escapeKey(device.StationID)
+		}
+
+		if device.StationName != "" {
+			tags += ",station_name=" + escapeKey(device.StationName)
+		}
+	}
+
+	return tags
+}
+
+func (x *InfluxDB) encode(lines []string) ([]byte, error) {
+	payload := []byte(strings.Join(lines, "\n") + "\n")
+	if !x.config.Gzip {
+		return payload, nil
+	}
+
+	var buffer bytes.Buffer
+
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, fmt.Errorf("%w: failed to compress lines: %w", ErrDelivery, err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("%w: failed to compress lines: %w", ErrDelivery, err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (x *InfluxDB) post(ctx context.Context, payload []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, x.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("%w: failed to create request: %w", ErrDelivery, err)
+	}
+
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	request.Header.Set("User-Agent", "foxess-exporter 1.0")
+
+	if x.config.Gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	x.config.authorise(request)
+
+	if x.config.Token != "" {
+		request.Header.Set("Authorization", "Token "+x.config.Token)
+	}
+
+	response, err := x.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: failed to complete request '%s': %w", ErrDelivery, x.endpoint, err)
+	}
+	defer response.Body.Close()
+
+	return checkResponse(response)
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func escapeMeasurement(measurement string) string {
+	return measurementEscaper.Replace(measurement)
+}
+
+// escapeKey escapes a tag key, tag value or field key.
+func escapeKey(key string) string {
+	return keyEscaper.Replace(key)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,408 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+const (
+	payloadOnline  = "online"
+	payloadOffline = "offline"
+	// disconnectQuiesce is how long, in milliseconds, outstanding work is given when disconnecting.
+	disconnectQuiesce = 250
+	// mqttBacklog is how many batches of messages may wait to be published before new ones are dropped.
+	mqttBacklog = 100
+)
+
+var ErrNotConnected = errors.New("not connected to the MQTT broker")
+
+// MQTTConfig configures publishing real-time data to an MQTT broker, with Home Assistant discovery.
+type MQTTConfig struct {
+	Broker          string        `long:"broker"           description:"Broker URL, enabling the sink"           env:"BROKER"                                                yaml:"broker"`
+	ClientID        string        `long:"client-id"        description:"Client ID to connect with"                              default:"foxess-exporter"                    yaml:"client-id"`
+	Username        string        `long:"username"         description:"Username"                                env:"USERNAME"                                              yaml:"username"`
+	Password        string        `long:"password"         description:"Password"                                env:"PASSWORD"                                              yaml:"password"`
+	TopicPrefix     string        `long:"topic-prefix"     description:"Prefix of the topics published to"                      default:"foxess"                             yaml:"topic-prefix"`
+	DiscoveryPrefix string        `long:"discovery-prefix" description:"Home Assistant discovery prefix"                        default:"homeassistant"                      yaml:"discovery-prefix"`
+	NoDiscovery     bool          `long:"no-discovery"     description:"Do not publish Home Assistant discovery"                                                             yaml:"no-discovery"`
+	QoS             byte          `long:"qos"              description:"Quality of service to publish with"                     default:"0" choice:"0" choice:"1" choice:"2" yaml:"qos"`
+	Timeout         time.Duration `long:"timeout"          description:"Time allowed to connect and publish"                    default:"10s"                                yaml:"timeout"`
+	TLSConfig       `yaml:",inline"`
+}
+
+// MQTT publishes each variable to {prefix}/{inverter}/{variable} as a retained message, along with the availability
+// of each inverter, and announces them to Home Assistant.
+type MQTT struct {
+	config    *MQTTConfig
+	client    mqtt.Client
+	counters  map[string]bool
+	latest    *latest
+	mutex     sync.Mutex
+	devices   map[string]foxess.Device
+	available map[string]string
+	announced map[string]bool
+	pending   chan []message
+	closed    bool
+	done      chan struct{}
+}
+
+// NewMQTT connects to the broker, retrying in the background if it is unavailable. Variables listed as counters are
+// announced as increasing totals.
+func NewMQTT(config *MQTTConfig, counters []string) (*MQTT, error) {
+	if config.QoS > 2 { //nolint:mnd
+		return nil, fmt.Errorf("%w: MQTT QoS must be 0, 1 or 2", ErrInvalidConfig)
+	}
+
+	tlsConfig, err := config.TLSConfig.config()
+	if err != nil {
+		return nil, err
+	}
+
+	x := &MQTT{
+		config:    config,
+		client:    nil,
+		counters:  make(map[string]bool, len(counters)),
+		latest:    newLatest(),
+		mutex:     sync.Mutex{},
+		devices:   make(map[string]foxess.Device),
+		available: make(map[string]string),
+		announced: make(map[string]bool),
+		pending:   make(chan []message, mqttBacklog),
+		closed:    false,
+		done:      make(chan struct{}),
+	}
+
+	for _, counter := range counters {
+		x.counters[counter] = true
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetTLSConfig(tlsConfig).
+		SetConnectTimeout(config.Timeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(x.statusTopic(), payloadOffline, config.QoS, true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			client.Publish(x.statusTopic(), config.QoS, true, payloadOnline)
+		})
+
+	x.client = mqtt.NewClient(options)
+	if token := x.client.Connect(); !token.WaitTimeout(config.Timeout) {
+		log.Printf("Unable to connect to MQTT broker %s yet, retrying in the background", config.Broker)
+	} else if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("%w: failed to connect to MQTT broker: %w", ErrDelivery, err)
+	}
+
+	go x.run()
+
+	return x, nil
+}
+
+// WriteDevices publishes the availability of each inverter, which is online unless FoxESS reports it offline.
+func (x *MQTT) WriteDevices(devices []foxess.Device) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var messages []message
+
+	available := make(map[string]string)
+
+	for _, device := range devices {
+		inverter := device.DeviceSerialNumber
+		if x.devices[inverter] != device {
+			// Announce again with the updated device details.
+			x.devices[inverter] = device
+			x.forget(inverter)
+		}
+
+		availability := payloadOnline
+		if device.Status != foxess.StatusOnline && device.Status != foxess.StatusFault {
+			availability = payloadOffline
+		}
+
+		if x.available[inverter] != availability {
+			available[inverter] = availability
+			messages = append(messages, message{x.availabilityTopic(inverter), availability})
+		}
+	}
+
+	// Availability is only remembered once queued, so that it is published again should it be dropped.
+	if err := x.publish(messages); err != nil {
+		return err
+	}
+
+	maps.Copy(x.available, available)
+
+	return nil
+}
+
+// Write publishes the samples FoxESS has recorded since the last write, first announcing any new variables.
+func (x *MQTT) Write(data []foxess.RealTimeData) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var (
+		messages  []message
+		announced []string
+	)
+
+	for _, result := range x.latest.fresh(data) {
+		for _, variable := range result.Variables {
+			key := result.DeviceSN + "/" + variable.Variable
+
+			if !x.config.NoDiscovery && !x.announced[key] {
+				discovery, err := x.discovery(result.DeviceSN, variable)
+				if err != nil {
+					return err
+				}
+
+				messages = append(messages, discovery)
+				announced = append(announced, key)
+			}
+
+			messages = append(messages, message{x.stateTopic(result.DeviceSN, variable.Variable), formatFloat(variable.Value.Number)})
+		}
+	}
+
+	// Discovery is only remembered once queued, so that it is announced again should it be dropped.
+	if err := x.publish(messages); err != nil {
+		return err
+	}
+
+	for _, key := range announced {
+		x.announced[key] = true
+	}
+
+	return nil
+}
+
+// Close publishes what is pending, until the context is done, then marks the exporter offline and disconnects.
+func (x *MQTT) Close(ctx context.Context) error {
+	defer x.client.Disconnect(disconnectQuiesce)
+
+	x.mutex.Lock()
+	if !x.closed {
+		x.closed = true
+		close(x.pending)
+	}
+	x.mutex.Unlock()
+
+	select {
+	case <-x.done:
+	case <-ctx.Done():
+	}
+
+	if !x.client.IsConnectionOpen() {
+		return nil
+	}
+
+	token := x.client.Publish(x.statusTopic(), x.config.QoS, true, payloadOffline)
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("%w: failed to publish MQTT status: %w", ErrDelivery, err)
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("%w: failed to publish MQTT status: %w", ErrDelivery, ctx.Err())
+	}
+
+	return nil
+}
+
+type message struct {
+	topic   string
+	payload string
+}
+
+// publish queues retained messages for the background publisher, so a slow broker cannot hold up polling.
+func (x *MQTT) publish(messages []message) error {
+	if len(messages) == 0 || x.closed {
+		return nil
+	}
+
+	if !x.client.IsConnectionOpen() {
+		// Discovery and availability are repeated once connected, and states on the next poll.
+		x.announced = make(map[string]bool)
+		x.available = make(map[string]string)
+
+		return fmt.Errorf("%w: %w", ErrDelivery, ErrNotConnected)
+	}
+
+	select {
+	case x.pending <- messages:
+		return nil
+	default:
+		return fmt.Errorf("%w: MQTT publish backlog is full, dropping messages", ErrDelivery)
+	}
+}
+
+func (x *MQTT) run() {
+	defer close(x.done)
+
+	for messages := range x.pending {
+		if err := x.send(messages); err != nil {
+			log.Printf("Unable to publish to MQTT: %v", err)
+		}
+	}
+}
+
+// send publishes messages, waiting up to the timeout for them all to complete.
+func (x *MQTT) send(messages []message) error {
+	tokens := make([]mqtt.Token, len(messages))
+	for i, message := range messages {
+		tokens[i] = x.client.Publish(message.topic, x.config.QoS, true, message.payload)
+	}
+
+	var errs []error
+
+	deadline := time.Now().Add(x.config.Timeout)
+	for i, token := range tokens {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			errs = append(errs, fmt.Errorf("%w: timed out publishing to '%s'", ErrDelivery, messages[i].topic))
+		} else if err := token.Error(); err != nil {
+			errs = append(errs, fmt.Errorf("%w: failed to publish to '%s': %w", ErrDelivery, messages[i].topic, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (x *MQTT) forget(inverter string) {
+	for key := range x.announced {
+		if strings.HasPrefix(key, inverter+"/") {
+			delete(x.announced, key)
+		}
+	}
+}
+
+func (x *MQTT) statusTopic() string {
+	return x.config.TopicPrefix + "/status"
+}
+
+func (x *MQTT) availabilityTopic(inverter string) string {
+	return x.config.TopicPrefix + "/" + inverter + "/availability"
+}
+
+func (x *MQTT) stateTopic(inverter, variable string) string {
+	return x.config.TopicPrefix + "/" + inverter + "/" + variable
+}
+
+// discoveryConfig is a Home Assistant MQTT sensor config.
+type discoveryConfig struct {
+	Name              string           `json:"name"`
+	UniqueID          string           `json:"unique_id"`
+	StateTopic        string           `json:"state_topic"`
+	Availability      []discoveryTopic `json:"availability"`
+	AvailabilityMode  string           `json:"availability_mode"`
+	DeviceClass       string           `json:"device_class,omitempty"`
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"`
+	StateClass        string           `json:"state_class"`
+	Device            discoveryDevice  `json:"device"`
+}
+
+type discoveryTopic struct {
+	Topic string `json:"topic"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number"`
+}
+
+func (x *MQTT) discovery(inverter string, variable foxess.RealTimeVariable) (message, error) {
+	device := x.devices[inverter]
+	deviceClass, unit, stateClass := classify(variable, x.counters[variable.Variable])
+
+	name := variable.Name
+	if name == "" {
+		name = variable.Variable
+	}
+
+	model := device.ProductType
+	if device.DeviceType != "" {
+		model = device.DeviceType
+	}
+
+	config := discoveryConfig{
+		Name:       name,
+		UniqueID:   "foxess_" + inverter + "_" + variable.Variable,
+		StateTopic: x.stateTopic(inverter, variable.Variable),
+		Availability: []discoveryTopic{
+			{Topic: x.statusTopic()},
+			{Topic: x.availabilityTopic(inverter)},
+		},
+		AvailabilityMode:  "all",
+		DeviceClass:       deviceClass,
+		UnitOfMeasurement: unit,
+		StateClass:        stateClass,
+		Device: discoveryDevice{
+			Identifiers:  []string{"foxess_" + inverter},
+			Name:         "FoxESS " + inverter,
+			Manufacturer: "FoxESS",
+			Model:        model,
+			SerialNumber: inverter,
+		},
+	}
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return message{}, fmt.Errorf("%w: failed to encode discovery config: %w", ErrDelivery, err)
+	}
+
+	topic := x.config.DiscoveryPrefix + "/sensor/foxess_" + inverter + "/" + variable.Variable + "/config"
+
+	return message{topic, string(payload)}, nil
+}
+
+// classify chooses the Home Assistant device class, unit and state class from the unit FoxESS reports.
+func classify(variable foxess.RealTimeVariable, counter bool) (string, string, string) {
+	switch variable.Unit {
+	case "kW", "W":
+		return "power", variable.Unit, "measurement"
+	case "kWh", "Wh":
+		if counter {
+			return "energy", variable.Unit, "total_increasing"
+		}
+
+		return "energy_storage", variable.Unit, "measurement"
+	case "V":
+		return "voltage", variable.Unit, "measurement"
+	case "A":
+		return "current", variable.Unit, "measurement"
+	case "Hz":
+		return "frequency", variable.Unit, "measurement"
+	case "℃", "°C":
+		return "temperature", "°C", "measurement"
+	case "kVar", "kvar", "Var", "var":
+		return "reactive_power", strings.ToLower(variable.Unit), "measurement"
+	case "kVA", "VA":
+		return "apparent_power", variable.Unit, "measurement"
+	case "%":
+		if variable.Variable == "SoC" {
+			return "battery", variable.Unit, "measurement"
+		}
+	}
+
+	if counter {
+		return "", variable.Unit, "total_increasing"
+	}
+
+	return "", variable.Unit, "measurement"
+}
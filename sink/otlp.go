@@ -0,0 +1,318 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+	// otlpBacklog is how many exports may wait for the exporter before new ones are dropped.
+	otlpBacklog = 100
+	serviceName = "foxess-exporter"
+)
+
+// OTLPConfig configures exporting metrics with the OpenTelemetry protocol.
+type OTLPConfig struct {
+	Endpoint  string            `long:"endpoint" description:"Endpoint URL, enabling OTLP export"              env:"ENDPOINT"                                                              yaml:"endpoint"`
+	Protocol  string            `long:"protocol" description:"OTLP transport"                                                 default:"http/protobuf" choice:"grpc" choice:"http/protobuf" yaml:"protocol"`
+	Headers   map[string]string `long:"header"   description:"Extra header, as name:value"                                                                                                 yaml:"headers"`
+	Timeout   time.Duration     `long:"timeout"  description:"Time allowed for each export, including retries"                default:"10s"                                                yaml:"timeout"`
+	Gzip      bool              `long:"gzip"     description:"Compress exports with gzip"                                                                                                  yaml:"gzip"`
+	TLSConfig `yaml:",inline"`
+}
+
+// OTLP exports real-time data, device status and the API quota as OpenTelemetry metrics, with a resource per
+// inverter describing it and its station.
+type OTLP struct {
+	exporter sdkmetric.Exporter
+	counters map[string]bool
+	start    time.Time
+	latest   *latest
+	mutex    sync.Mutex
+	devices  map[string]foxess.Device
+	pending  chan *metricdata.ResourceMetrics
+	closed   bool
+	done     chan struct{}
+}
+
+// NewOTLP creates an exporter for the configured endpoint. Variables listed as counters are exported as monotonic
+// sums, and the others as gauges.
+func NewOTLP(ctx context.Context, config *OTLPConfig, counters []string) (*OTLP, error) {
+	exporter, err := config.exporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &OTLP{
+		exporter: exporter,
+		counters: make(map[string]bool, len(counters)),
+		start:    time.Now(),
+		latest:   newLatest(),
+		mutex:    sync.Mutex{},
+		devices:  make(map[string]foxess.Device),
+		pending:  make(chan *metricdata.ResourceMetrics, otlpBacklog),
+		closed:   false,
+		done:     make(chan struct{}),
+	}
+
+	for _, counter := range counters {
+		x.counters[counter] = true
+	}
+
+	go x.run()
+
+	return x, nil
+}
+
+func (c *OTLPConfig) exporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("%w: invalid OTLP endpoint '%s'", ErrInvalidConfig, c.Endpoint)
+	}
+
+	tlsConfig, err := c.TLSConfig.config()
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Protocol {
+	case ProtocolGRPC:
+		options := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpointURL(c.Endpoint),
+			otlpmetricgrpc.WithHeaders(c.Headers),
+			otlpmetricgrpc.WithTimeout(c.Timeout),
+		}
+
+		if endpoint.Scheme == "https" {
+			options = append(options, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+
+		if c.Gzip {
+			options = append(options, otlpmetricgrpc.WithCompressor("gzip"))
+		}
+
+		exporter, err := otlpmetricgrpc.New(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to create OTLP exporter: %w", ErrInvalidConfig, err)
+		}
+
+		return exporter, nil
+	case ProtocolHTTP:
+		// As with OTEL_EXPORTER_OTLP_ENDPOINT, a base URL is given the metrics path.
+		if strings.Trim(endpoint.Path, "/") == "" {
+			endpoint.Path = "/v1/metrics"
+		}
+
+		options := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpointURL(endpoint.String()),
+			otlpmetrichttp.WithHeaders(c.Headers),
+			otlpmetrichttp.WithTimeout(c.Timeout),
+			otlpmetrichttp.WithTLSClientConfig(tlsConfig),
+		}
+
+		if c.Gzip {
+			options = append(options, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+		}
+
+		exporter, err := otlpmetrichttp.New(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to create OTLP exporter: %w", ErrInvalidConfig, err)
+		}
+
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown OTLP protocol '%s'", ErrInvalidConfig, c.Protocol)
+	}
+}
+
+// Write exports the samples FoxESS has recorded since the last write, timestamped with when it recorded them.
+func (x *OTLP) Write(data []foxess.RealTimeData) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for _, result := range x.latest.fresh(data) {
+		metrics := make([]metricdata.Metrics, 0, len(result.Variables))
+
+		for _, variable := range result.Variables {
+			point := metricdata.DataPoint[float64]{ //nolint:exhaustruct
+				StartTime: x.start,
+				Time:      result.Time.Time,
+				Value:     variable.Value.Number,
+			}
+
+			var aggregation metricdata.Aggregation = metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{point}}
+			if x.counters[variable.Variable] {
+				aggregation = metricdata.Sum[float64]{
+					DataPoints:  []metricdata.DataPoint[float64]{point},
+					Temporality: metricdata.CumulativeTemporality,
+					IsMonotonic: true,
+				}
+			}
+
+			metrics = append(metrics, metricdata.Metrics{
+				Name:        "foxess.realtime." + variable.Variable,
+				Description: variable.Name,
+				Unit:        otlpUnit(variable.Unit),
+				Data:        aggregation,
+			})
+		}
+
+		if err := x.export(x.inverterResource(result.DeviceSN), metrics); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteDevices records each inverter's station and product for its resource, and exports its status.
+func (x *OTLP) WriteDevices(devices []foxess.Device) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	now := time.Now()
+
+	for _, device := range devices {
+		x.devices[device.DeviceSerialNumber] = device
+
+		status := metricdata.Metrics{
+			Name:        "foxess.device.status",
+			Description: "Device status: 1 online, 2 fault, 3 offline.",
+			Unit:        "1",
+			Data: metricdata.Gauge[int64]{DataPoints: []metricdata.DataPoint[int64]{
+				{Time: now, Value: int64(device.Status)}, //nolint:exhaustruct
+			}},
+		}
+
+		if err := x.export(x.inverterResource(device.DeviceSerialNumber), []metricdata.Metrics{status}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteQuota exports the API quota, which belongs to the exporter rather than any inverter.
+func (x *OTLP) WriteQuota(usage *foxess.APIUsage) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	now := time.Now()
+	gauge := func(name, description, unit string, value float64) metricdata.Metrics {
+		return metricdata.Metrics{
+			Name:        name,
+			Description: description,
+			Unit:        unit,
+			Data: metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{
+				{Time: now, Value: value}, //nolint:exhaustruct
+			}},
+		}
+	}
+
+	return x.export(resource.NewSchemaless(attribute.String("service.name", serviceName)), []metricdata.Metrics{
+		gauge("foxess.api.quota.total", "Daily API call allowance.", "{call}", usage.Total),
+		gauge("foxess.api.quota.remaining", "API calls remaining today.", "{call}", usage.Remaining),
+		gauge("foxess.api.quota.used", "Proportion of the daily API allowance used.", "1", usage.PercentageUsed/100), //nolint:mnd
+	})
+}
+
+// Close exports what is pending, until the context is done, and shuts the exporter down.
+func (x *OTLP) Close(ctx context.Context) error {
+	x.mutex.Lock()
+	if !x.closed {
+		x.closed = true
+		close(x.pending)
+	}
+	x.mutex.Unlock()
+
+	select {
+	case <-x.done:
+	case <-ctx.Done():
+	}
+
+	if err := x.exporter.Shutdown(ctx); err != nil {
+		return fmt.Errorf("%w: failed to shut down OTLP exporter: %w", ErrDelivery, err)
+	}
+
+	return nil
+}
+
+func (x *OTLP) inverterResource(inverter string) *resource.Resource {
+	attributes := []attribute.KeyValue{
+		attribute.String("service.name", serviceName),
+		attribute.String("foxess.inverter", inverter),
+	}
+
+	if device, ok := x.devices[inverter]; ok {
+		attributes = append(attributes,
+			attribute.String("foxess.station.id", device.StationID),
+			attribute.String("foxess.station.name", device.StationName),
+			attribute.String("foxess.product_type", device.ProductType),
+			attribute.String("foxess.device_type", device.DeviceType),
+		)
+	}
+
+	return resource.NewSchemaless(attributes...)
+}
+
+// export queues the metrics for the background exporter, dropping them if it has fallen too far behind.
+func (x *OTLP) export(resource *resource.Resource, metrics []metricdata.Metrics) error {
+	if len(metrics) == 0 || x.closed {
+		return nil
+	}
+
+	select {
+	case x.pending <- &metricdata.ResourceMetrics{
+		Resource: resource,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: "github.com/teh-hippo/foxess-exporter"}, //nolint:exhaustruct
+			Metrics: metrics,
+		}},
+	}:
+		return nil
+	default:
+		return fmt.Errorf("%w: OTLP export backlog is full, dropping metrics", ErrDelivery)
+	}
+}
+
+func (x *OTLP) run() {
+	defer close(x.done)
+
+	for metrics := range x.pending {
+		// The exporter retries transient failures within its timeout.
+		if err := x.exporter.Export(context.Background(), metrics); err != nil {
+			log.Printf("Unable to export OTLP metrics: %v", err)
+		}
+	}
+}
+
+// otlpUnit converts the units FoxESS reports to UCUM, as OpenTelemetry expects.
+func otlpUnit(unit string) string {
+	switch unit {
+	case "":
+		return "1"
+	case "℃", "°C":
+		return "Cel"
+	case "kVar", "kvar":
+		return "kvar"
+	default:
+		return unit
+	}
+}
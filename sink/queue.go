@@ -0,0 +1,282 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueSuffix = ".batch"
+
+// Queue holds payloads awaiting delivery, in memory or, given a directory, on disk so they survive restarts. Once
+// full, the oldest payload is dropped.
+type Queue struct {
+	mutex    sync.Mutex
+	dir      string
+	limit    int
+	payloads [][]byte
+	files    []string
+	next     uint64
+	popped   uint64
+}
+
+func NewQueue(dir string, limit int) (*Queue, error) {
+	queue := &Queue{mutex: sync.Mutex{}, dir: dir, limit: max(limit, 1), payloads: nil, files: nil, next: 0, popped: 0}
+	if dir == "" {
+		return queue, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), queueSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), queueSuffix) {
+			continue
+		}
+
+		queue.files = append(queue.files, entry.Name())
+		queue.next = max(queue.next, sequence+1)
+	}
+
+	slices.Sort(queue.files)
+
+	if len(queue.files) > 0 {
+		log.Printf("Resuming delivery of %d queued payloads from %s", len(queue.files), dir)
+	}
+
+	return queue, nil
+}
+
+// Push adds a payload, dropping the oldest if the queue is full.
+func (q *Queue) Push(payload []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.length() >= q.limit {
+		log.Printf("Delivery queue is full, dropping the oldest payload")
+		q.pop()
+	}
+
+	if q.dir == "" {
+		q.payloads = append(q.payloads, payload)
+
+		return nil
+	}
+
+	name := fmt.Sprintf("%020d%s", q.next, queueSuffix)
+	temporary := filepath.Join(q.dir, "."+name)
+
+	if err := os.WriteFile(temporary, payload, 0o600); err != nil {
+		return fmt.Errorf("failed to queue payload: %w", err)
+	}
+
+	if err := os.Rename(temporary, filepath.Join(q.dir, name)); err != nil {
+		return fmt.Errorf("failed to queue payload: %w", err)
+	}
+
+	q.files = append(q.files, name)
+	q.next++
+
+	return nil
+}
+
+// Peek returns the oldest payload without removing it, and its position for Pop.
+func (q *Queue) Peek() ([]byte, uint64, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.dir != "" && len(q.files) > 0 {
+		payload, err := os.ReadFile(filepath.Join(q.dir, q.files[0]))
+		if err == nil {
+			return payload, q.popped, true
+		}
+
+		log.Printf("Dropping unreadable queued payload: %v", err)
+		q.pop()
+	}
+
+	if len(q.payloads) == 0 {
+		return nil, 0, false
+	}
+
+	return q.payloads[0], q.popped, true
+}
+
+// Pop removes the payload at the position returned by Peek, unless a full queue has since dropped it.
+func (q *Queue) Pop(position uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if position == q.popped {
+		q.pop()
+	}
+}
+
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.length()
+}
+
+func (q *Queue) length() int {
+	return len(q.payloads) + len(q.files)
+}
+
+func (q *Queue) pop() {
+	if len(q.files) > 0 {
+		if err := os.Remove(filepath.Join(q.dir, q.files[0])); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Unable to remove queued payload: %v", err)
+		}
+
+		q.files = q.files[1:]
+		q.popped++
+	} else if len(q.payloads) > 0 {
+		q.payloads = q.payloads[1:]
+		q.popped++
+	}
+}
+
+// delivery sends queued payloads in the background, retrying recoverable failures with exponential backoff.
+type delivery struct {
+	name    string
+	queue   *Queue
+	send    func(ctx context.Context, payload []byte) error
+	config  *QueueConfig
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	cancel  context.CancelFunc
+}
+
+func newDelivery(name string, config *QueueConfig, send func(ctx context.Context, payload []byte) error) (*delivery, error) {
+	queue, err := NewQueue(config.QueueDir, config.QueueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &delivery{
+		name:    name,
+		queue:   queue,
+		send:    send,
+		config:  config,
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+
+	go d.run(ctx)
+
+	return d, nil
+}
+
+func (d *delivery) enqueue(payload []byte) error {
+	if err := d.queue.Push(payload); err != nil {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (d *delivery) run(ctx context.Context) {
+	defer close(d.done)
+
+	attempt := 0
+
+	for {
+		payload, position, ok := d.queue.Peek()
+		if !ok {
+			select {
+			case <-d.wake:
+				continue
+			case <-d.closing:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := d.send(ctx, payload)
+
+		var httpError *HTTPError
+
+		switch {
+		case err == nil:
+			d.queue.Pop(position)
+
+			attempt = 0
+		case errors.As(err, &httpError) && !httpError.Recoverable():
+			log.Printf("Dropping payload rejected by %s: %v", d.name, err)
+			d.queue.Pop(position)
+
+			attempt = 0
+		case ctx.Err() != nil:
+			return
+		default:
+			backoff := d.backoff(attempt)
+			attempt++
+			log.Printf("Unable to deliver to %s, retrying in %v: %v", d.name, backoff, err)
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (d *delivery) backoff(attempt int) time.Duration {
+	backoff := d.config.MinBackoff
+	for range attempt {
+		backoff *= 2
+		if backoff >= d.config.MaxBackoff {
+			return d.config.MaxBackoff
+		}
+	}
+
+	return backoff
+}
+
+// close delivers what remains in the queue until the context is done, after which anything undelivered is lost
+// unless queued on disk.
+func (d *delivery) close(ctx context.Context) error {
+	close(d.closing)
+
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		d.cancel()
+		<-d.done
+	}
+
+	d.cancel()
+
+	if remaining := d.queue.Len(); remaining > 0 {
+		return fmt.Errorf("%w: %d payloads left undelivered to %s", ErrDelivery, remaining, d.name)
+	}
+
+	return nil
+}
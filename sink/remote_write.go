@@ -0,0 +1,238 @@
+package sink
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+var ErrInvalidConfig = errors.New("invalid sink configuration")
+
+// RemoteWriteConfig configures pushing real-time data with the Prometheus remote-write protocol.
+type RemoteWriteConfig struct {
+	URL         string `long:"url"        description:"Prometheus remote-write endpoint, enabling push mode" env:"URL"               yaml:"url"`
+	BatchSize   int    `long:"batch-size" description:"Most time series to send in each request"                       default:"500" yaml:"batch-size"`
+	HTTPConfig  `yaml:",inline"`
+	QueueConfig `yaml:",inline"`
+}
+
+// RemoteWriteClient sends time series to a remote-write endpoint.
+type RemoteWriteClient struct {
+	url    string
+	client *http.Client
+	config *HTTPConfig
+}
+
+func NewRemoteWriteClient(url string, config *HTTPConfig) (*RemoteWriteClient, error) {
+	client, err := config.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteWriteClient{url: url, client: client, config: config}, nil
+}
+
+// Send writes the time series in a single request.
+func (c *RemoteWriteClient) Send(ctx context.Context, timeSeries []prompb.TimeSeries) error {
+	payload, err := encodeWriteRequest(timeSeries)
+	if err != nil {
+		return err
+	}
+
+	return c.post(ctx, payload)
+}
+
+// post sends a snappy-compressed, protobuf-encoded write request.
+func (c *RemoteWriteClient) post(ctx context.Context, payload []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("%w: failed to create request: %w", ErrDelivery, err)
+	}
+
+	request.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
+	request.Header.Add("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("User-Agent", "foxess-exporter 1.0")
+	c.config.authorise(request)
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: failed to complete request '%s': %w", ErrDelivery, c.url, err)
+	}
+	defer response.Body.Close()
+
+	return checkResponse(response)
+}
+
+func checkResponse(response *http.Response) error {
+	if response.StatusCode >= http.StatusOK && response.StatusCode < http.StatusMultipleChoices {
+		_, _ = io.Copy(io.Discard, response.Body)
+
+		return nil
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %d response, and unable to read response: %w", ErrDelivery, response.StatusCode, err)
+	}
+
+	return &HTTPError{StatusCode: response.StatusCode, Message: strings.Trim(string(body), "\n")}
+}
+
+func encodeWriteRequest(timeSeries []prompb.TimeSeries) ([]byte, error) {
+	marshalled, err := proto.Marshal(&prompb.WriteRequest{ //nolint:exhaustruct
+		Timeseries: timeSeries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to marshal time series: %w", ErrDelivery, err)
+	}
+
+	return snappy.Encode(nil, marshalled), nil
+}
+
+// RemoteWrite pushes each new real-time sample, timestamped with the time FoxESS recorded it, as
+// foxess_realtime_data{inverter,variable}.
+type RemoteWrite struct {
+	client    *RemoteWriteClient
+	delivery  *delivery
+	batchSize int
+	latest    *latest
+}
+
+func NewRemoteWrite(config *RemoteWriteConfig) (*RemoteWrite, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := NewRemoteWriteClient(config.URL, &config.HTTPConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, err := newDelivery("remote-write", &config.QueueConfig, client.post)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteWrite{
+		client:    client,
+		delivery:  delivery,
+		batchSize: config.BatchSize,
+		latest:    newLatest(),
+	}, nil
+}
+
+func (c *RemoteWriteConfig) validate() error {
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("%w: remote-write batch size must be positive", ErrInvalidConfig)
+	}
+
+	return c.QueueConfig.validate()
+}
+
+func (c *QueueConfig) validate() error {
+	if c.MinBackoff <= 0 || c.MaxBackoff < c.MinBackoff {
+		return fmt.Errorf("%w: backoff must be positive, with the maximum at least the minimum", ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// Write queues the samples FoxESS has recorded since the last write, in batches.
+func (x *RemoteWrite) Write(data []foxess.RealTimeData) error {
+	return x.enqueue(newTimeSeries(x.latest.fresh(data)))
+}
+
+// WriteHistory queues historical data, such as to fill a gap, keeping the time FoxESS recorded each point.
+func (x *RemoteWrite) WriteHistory(histories []foxess.InverterHistory) error {
+	return x.enqueue(HistoryTimeSeries(histories, false))
+}
+
+func (x *RemoteWrite) enqueue(timeSeries []prompb.TimeSeries) error {
+	for batch := range slices.Chunk(timeSeries, x.batchSize) {
+		payload, err := encodeWriteRequest(batch)
+		if err != nil {
+			return err
+		}
+
+		if err := x.delivery.enqueue(payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *RemoteWrite) Close(ctx context.Context) error {
+	return x.delivery.close(ctx)
+}
+
+func newTimeSeries(data []foxess.RealTimeData) []prompb.TimeSeries {
+	var timeSeries []prompb.TimeSeries
+
+	for _, result := range data {
+		for _, variable := range result.Variables {
+			timeSeries = append(timeSeries, prompb.TimeSeries{ //nolint:exhaustruct
+				Labels:  realTimeLabels(result.DeviceSN, variable.Variable),
+				Samples: []prompb.Sample{{Timestamp: result.Time.UnixMilli(), Value: variable.Value.Number}}, //nolint:exhaustruct
+			})
+		}
+	}
+
+	return timeSeries
+}
+
+// HistoryTimeSeries converts history into time series of foxess_realtime_data, with the time FoxESS recorded each point.
+// When markEnd is set, each series is ended with a stale marker just after its last point.
+func HistoryTimeSeries(histories []foxess.InverterHistory, markEnd bool) []prompb.TimeSeries {
+	var timeSeries []prompb.TimeSeries
+
+	for _, history := range histories {
+		for _, variable := range history.Variables {
+			if len(variable.DataPoints) == 0 {
+				continue
+			}
+
+			samples := make([]prompb.Sample, len(variable.DataPoints), len(variable.DataPoints)+1)
+			for i, point := range variable.DataPoints {
+				samples[i] = prompb.Sample{Timestamp: point.Time.UnixMilli(), Value: point.Value.Number} //nolint:exhaustruct
+			}
+
+			slices.SortFunc(samples, func(a, b prompb.Sample) int {
+				return cmp.Compare(a.Timestamp, b.Timestamp)
+			})
+
+			if markEnd {
+				samples = append(samples, prompb.Sample{Timestamp: samples[len(samples)-1].Timestamp + 1, Value: math.Float64frombits(value.StaleNaN)}) //nolint:exhaustruct
+			}
+
+			timeSeries = append(timeSeries, prompb.TimeSeries{ //nolint:exhaustruct
+				Labels:  realTimeLabels(history.DeviceSN, variable.Variable),
+				Samples: samples,
+			})
+		}
+	}
+
+	return timeSeries
+}
+
+func realTimeLabels(inverter, variable string) []prompb.Label {
+	return []prompb.Label{
+		{Name: "__name__", Value: "foxess_realtime_data"}, //nolint:exhaustruct
+		{Name: "inverter", Value: inverter},               //nolint:exhaustruct
+		{Name: "variable", Value: variable},               //nolint:exhaustruct
+	}
+}
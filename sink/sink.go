@@ -0,0 +1,164 @@
+// Package sink delivers real-time data from serve to systems that cannot scrape it.
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+)
+
+var (
+	ErrDelivery   = errors.New("failed to deliver")
+	ErrInvalidTLS = errors.New("invalid TLS configuration")
+)
+
+// Sink receives real-time data as it is polled, delivering it in the background.
+type Sink interface {
+	Write(data []foxess.RealTimeData) error
+	Close(ctx context.Context) error
+}
+
+// DeviceWriter is implemented by sinks that also use the device list, such as for each inverter's station.
+type DeviceWriter interface {
+	WriteDevices(devices []foxess.Device) error
+}
+
+// QuotaWriter is implemented by sinks that also deliver the API quota.
+type QuotaWriter interface {
+	WriteQuota(usage *foxess.APIUsage) error
+}
+
+// HTTPError is an unsuccessful response from a sink's endpoint.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return ErrDelivery
+}
+
+// Recoverable reports whether the request may succeed if retried.
+func (e *HTTPError) Recoverable() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+}
+
+// TLSConfig secures the connection to a sink.
+type TLSConfig struct {
+	CAFile             string `long:"ca-file"              description:"CA certificate to verify the server with" yaml:"ca-file"`
+	CertFile           string `long:"cert-file"            description:"Client certificate"                       yaml:"cert-file"`
+	KeyFile            string `long:"key-file"             description:"Client certificate key"                   yaml:"key-file"`
+	InsecureSkipVerify bool   `long:"insecure-skip-verify" description:"Do not verify the server certificate"     yaml:"insecure-skip-verify"`
+}
+
+// HTTPConfig is how a sink connects and authenticates to its endpoint.
+type HTTPConfig struct {
+	Username    string            `long:"username"     description:"Basic authentication username" env:"USERNAME"                   yaml:"username"`
+	Password    string            `long:"password"     description:"Basic authentication password" env:"PASSWORD"                   yaml:"password"`
+	BearerToken string            `long:"bearer-token" description:"Bearer token"                  env:"BEARER_TOKEN"               yaml:"bearer-token"`
+	Headers     map[string]string `long:"header"       description:"Extra header, as name:value"                                    yaml:"headers"`
+	Timeout     time.Duration     `long:"timeout"      description:"Time allowed for each request"                    default:"10s" yaml:"timeout"`
+	TLSConfig   `yaml:",inline"`
+}
+
+// QueueConfig is how payloads awaiting delivery are held, and how often failed deliveries are retried.
+type QueueConfig struct {
+	QueueDir   string        `long:"queue-dir"   description:"Directory to queue payloads in while undeliverable, rather than memory"                yaml:"queue-dir"`
+	QueueSize  int           `long:"queue-size"  description:"Payloads to queue before dropping the oldest"                           default:"1000" yaml:"queue-size"`
+	MinBackoff time.Duration `long:"min-backoff" description:"Initial delay before retrying a failure"                                default:"1s"   yaml:"min-backoff"`
+	MaxBackoff time.Duration `long:"max-backoff" description:"Longest delay between retries"                                          default:"5m"   yaml:"max-backoff"`
+}
+
+// Client creates an HTTP client for the configuration.
+func (c *HTTPConfig) Client() (*http.Client, error) {
+	tlsConfig, err := c.TLSConfig.config()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, Timeout: c.Timeout}, nil //nolint:exhaustruct
+}
+
+// authorise adds the configured credentials and headers to the request.
+func (c *HTTPConfig) authorise(request *http.Request) {
+	for name, value := range c.Headers {
+		request.Header.Set(name, value)
+	}
+
+	if c.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	} else if c.Username != "" {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+func (c *TLSConfig) config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify} //nolint:exhaustruct,gosec
+
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read CA file: %w", ErrInvalidTLS, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: no certificates found in '%s'", ErrInvalidTLS, c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to load client certificate: %w", ErrInvalidTLS, err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// latest tracks the time of each inverter's most recent sample, so that unchanged data is only delivered once.
+type latest struct {
+	mutex sync.Mutex
+	times map[string]time.Time
+}
+
+func newLatest() *latest {
+	return &latest{mutex: sync.Mutex{}, times: make(map[string]time.Time)}
+}
+
+// fresh returns the data recorded since the last call.
+func (l *latest) fresh(data []foxess.RealTimeData) []foxess.RealTimeData {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var result []foxess.RealTimeData
+
+	for _, item := range data {
+		if !item.Time.After(l.times[item.DeviceSN]) {
+			continue
+		}
+
+		l.times[item.DeviceSN] = item.Time.Time
+		result = append(result, item)
+	}
+
+	return result
+}
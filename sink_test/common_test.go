@@ -0,0 +1,29 @@
+package sink_test
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/sink"
+)
+
+func realTimeData(inverter string, at time.Time, values map[string]float64) foxess.RealTimeData {
+	data := foxess.RealTimeData{DeviceSN: inverter, Time: foxess.CustomTime{Time: at}} //nolint:exhaustruct
+
+	for _, variable := range slices.Sorted(maps.Keys(values)) {
+		data.Variables = append(data.Variables, foxess.RealTimeVariable{
+			Variable: variable,
+			Unit:     "",
+			Name:     "",
+			Value:    foxess.NumberAsNil{Number: values[variable]},
+		})
+	}
+
+	return data
+}
+
+func queueConfig(dir string) sink.QueueConfig {
+	return sink.QueueConfig{QueueDir: dir, QueueSize: 10, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+}
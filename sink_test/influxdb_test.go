@@ -0,0 +1,172 @@
+package sink_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/sink"
+)
+
+type influxRequest struct {
+	path          string
+	query         url.Values
+	authorization string
+	lines         []string
+}
+
+// influxServer is an InfluxDB stand-in that responds with each status in turn, then 204.
+func influxServer(t *testing.T, statuses ...int) (*httptest.Server, func() []influxRequest) {
+	t.Helper()
+
+	var (
+		mutex    sync.Mutex
+		requests []influxRequest
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(r.Body)
+			assert.NoError(t, err)
+
+			body = reader
+		}
+
+		content, err := io.ReadAll(body)
+		assert.NoError(t, err)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		requests = append(requests, influxRequest{
+			path:          r.URL.Path,
+			query:         r.URL.Query(),
+			authorization: r.Header.Get("Authorization"),
+			lines:         strings.Split(strings.TrimSuffix(string(content), "\n"), "\n"),
+		})
+
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []influxRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return requests
+	}
+}
+
+func influxConfig(url string) *sink.InfluxDBConfig {
+	return &sink.InfluxDBConfig{ //nolint:exhaustruct
+		URL:          url,
+		APIVersion:   2,
+		Organisation: "home",
+		Bucket:       "solar",
+		Token:        "secret",
+		Layout:       sink.LayoutFields,
+		Measurement:  "foxess_realtime",
+		BatchSize:    100,
+		HTTPConfig:   sink.HTTPConfig{Timeout: time.Second}, //nolint:exhaustruct
+		QueueConfig:  queueConfig(""),
+	}
+}
+
+func TestInfluxDBWritesFieldsWithStationTags(t *testing.T) {
+	t.Parallel()
+
+	server, requests := influxServer(t)
+	config := influxConfig(server.URL)
+	config.Gzip = true
+	subject, err := sink.NewInfluxDB(config)
+	require.NoError(t, err)
+
+	at := time.UnixMilli(1704110400000)
+	require.NoError(t, subject.WriteDevices([]foxess.Device{
+		{DeviceSerialNumber: "SN1", StationID: "42", StationName: "My Home"}, //nolint:exhaustruct
+	}))
+	require.NoError(t, subject.Write([]foxess.RealTimeData{
+		realTimeData("SN1", at, map[string]float64{"pvPower": 1.5, "SoC": 80}),
+		realTimeData("SN2", at, map[string]float64{"pvPower": 0.25}),
+	}))
+	require.NoError(t, subject.Close(context.Background()))
+
+	received := requests()
+	require.Len(t, received, 1)
+	assert.Equal(t, "/api/v2/write", received[0].path)
+	assert.Equal(t, url.Values{"org": {"home"}, "bucket": {"solar"}, "precision": {"ms"}}, received[0].query)
+	assert.Equal(t, "Token secret", received[0].authorization)
+	assert.Equal(t, []string{
+		`foxess_realtime,inverter=SN1,station_id=42,station_name=My\ Home SoC=80,pvPower=1.5 1704110400000`,
+		`foxess_realtime,inverter=SN2 pvPower=0.25 1704110400000`,
+	}, received[0].lines)
+}
+
+func TestInfluxDBWritesMeasurementsToV1(t *testing.T) {
+	t.Parallel()
+
+	server, requests := influxServer(t, http.StatusServiceUnavailable)
+	config := influxConfig(server.URL + "/influx")
+	config.APIVersion = 1
+	config.Database = "foxess"
+	config.RetentionPolicy = "week"
+	config.Token = ""
+	config.Username = "user"
+	config.Password = "pass"
+	config.Layout = sink.LayoutMeasurements
+	config.BatchSize = 1
+	subject, err := sink.NewInfluxDB(config)
+	require.NoError(t, err)
+
+	at := time.UnixMilli(1704110400000)
+	data := []foxess.RealTimeData{realTimeData("SN1", at, map[string]float64{"pvPower": 1.5, "SoC": 80})}
+	require.NoError(t, subject.Write(data))
+	require.NoError(t, subject.Write(data))
+	require.NoError(t, subject.Close(context.Background()))
+
+	received := requests()
+	require.Len(t, received, 3, "the first batch is retried, and unchanged data is not written again")
+	assert.Equal(t, "/influx/write", received[0].path)
+	assert.Equal(t, url.Values{"db": {"foxess"}, "rp": {"week"}, "precision": {"ms"}}, received[0].query)
+	assert.True(t, strings.HasPrefix(received[0].authorization, "Basic "))
+	assert.Equal(t, []string{"SoC,inverter=SN1 value=80 1704110400000"}, received[1].lines)
+	assert.Equal(t, []string{"pvPower,inverter=SN1 value=1.5 1704110400000"}, received[2].lines)
+}
+
+func TestInfluxDBConfigIsValidated(t *testing.T) {
+	t.Parallel()
+
+	config := influxConfig("http://localhost:8086")
+	config.Bucket = ""
+	_, err := sink.NewInfluxDB(config)
+	require.ErrorIs(t, err, sink.ErrInvalidConfig)
+
+	config = influxConfig("http://localhost:8086")
+	config.APIVersion = 1
+	_, err = sink.NewInfluxDB(config)
+	require.ErrorIs(t, err, sink.ErrInvalidConfig)
+
+	config = influxConfig("http://localhost:8086")
+	config.Layout = "tables"
+	_, err = sink.NewInfluxDB(config)
+	require.ErrorIs(t, err, sink.ErrInvalidConfig)
+}
@@ -0,0 +1,312 @@
+package sink_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/sink"
+)
+
+const (
+	packetConnect    = 1
+	packetPublish    = 3
+	packetPingReq    = 12
+	packetDisconnect = 14
+)
+
+type published struct {
+	payload  string
+	retained bool
+}
+
+// broker is a minimal MQTT 3.1.1 broker that records what is published to it.
+type broker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages map[string]published
+	order    []string
+	stalled  atomic.Bool
+}
+
+func newBroker(t *testing.T) *broker {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	b := &broker{listener: listener, mutex: sync.Mutex{}, messages: make(map[string]published), order: nil, stalled: atomic.Bool{}}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *broker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		header, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case packetConnect:
+			_, _ = conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case packetPublish:
+			qos := (header >> 1) & 0x03
+			topicLength := int(binary.BigEndian.Uint16(body))
+			topic := string(body[2 : 2+topicLength])
+			payload := body[2+topicLength:]
+
+			if qos > 0 {
+				if !b.stalled.Load() {
+					_, _ = conn.Write([]byte{0x40, 0x02, payload[0], payload[1]})
+				}
+
+				payload = payload[2:]
+			}
+
+			b.mutex.Lock()
+			b.messages[topic] = published{payload: string(payload), retained: header&0x01 == 1}
+			b.order = append(b.order, topic)
+			b.mutex.Unlock()
+		case packetPingReq:
+			_, _ = conn.Write([]byte{0xd0, 0x00})
+		case packetDisconnect:
+			return
+		}
+	}
+}
+
+func (b *broker) message(t *testing.T, topic string) published {
+	t.Helper()
+
+	var message published
+
+	require.Eventually(t, func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		var ok bool
+		message, ok = b.messages[topic]
+
+		return ok
+	}, 5*time.Second, 10*time.Millisecond, "nothing published to %s", topic)
+
+	return message
+}
+
+func (b *broker) published() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.order
+}
+
+func mqttConfig(broker string) *sink.MQTTConfig {
+	return &sink.MQTTConfig{ //nolint:exhaustruct
+		Broker:          broker,
+		ClientID:        "test",
+		TopicPrefix:     "foxess",
+		DiscoveryPrefix: "homeassistant",
+		QoS:             1,
+		Timeout:         5 * time.Second,
+	}
+}
+
+func TestMQTTPublishesRetainedStatesWithDiscovery(t *testing.T) {
+	t.Parallel()
+
+	broker := newBroker(t)
+	subject, err := sink.NewMQTT(mqttConfig(broker.url()), []string{"generation"})
+	require.NoError(t, err)
+
+	assert.Equal(t, published{payload: "online", retained: true}, broker.message(t, "foxess/status"))
+
+	require.NoError(t, subject.WriteDevices([]foxess.Device{
+		{DeviceSerialNumber: "SN1", Status: foxess.StatusOnline, DeviceType: "H1-5.0-E"}, //nolint:exhaustruct
+	}))
+
+	data := realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 1.5, "generation": 1234.5, "SoC": 80})
+	data.Variables[0].Unit = "%"
+	data.Variables[1].Unit = "kWh"
+	data.Variables[2].Unit = "kW"
+	require.NoError(t, subject.Write([]foxess.RealTimeData{data}))
+
+	assert.Equal(t, published{payload: "online", retained: true}, broker.message(t, "foxess/SN1/availability"))
+	assert.Equal(t, published{payload: "1.5", retained: true}, broker.message(t, "foxess/SN1/pvPower"))
+	assert.Equal(t, "1234.5", broker.message(t, "foxess/SN1/generation").payload)
+
+	var discovery map[string]any
+
+	config := broker.message(t, "homeassistant/sensor/foxess_SN1/generation/config")
+	assert.True(t, config.retained)
+	require.NoError(t, json.Unmarshal([]byte(config.payload), &discovery))
+	assert.Equal(t, "foxess/SN1/generation", discovery["state_topic"])
+	assert.Equal(t, "energy", discovery["device_class"])
+	assert.Equal(t, "kWh", discovery["unit_of_measurement"])
+	assert.Equal(t, "total_increasing", discovery["state_class"])
+	assert.Equal(t, "foxess_SN1_generation", discovery["unique_id"])
+	assert.Equal(t, "H1-5.0-E", discovery["device"].(map[string]any)["model"]) //nolint:forcetypeassert
+	assert.Len(t, discovery["availability"], 2)
+
+	require.NoError(t, json.Unmarshal([]byte(broker.message(t, "homeassistant/sensor/foxess_SN1/pvPower/config").payload), &discovery))
+	assert.Equal(t, "power", discovery["device_class"])
+	assert.Equal(t, "measurement", discovery["state_class"])
+
+	require.NoError(t, json.Unmarshal([]byte(broker.message(t, "homeassistant/sensor/foxess_SN1/SoC/config").payload), &discovery))
+	assert.Equal(t, "battery", discovery["device_class"])
+
+	require.NoError(t, subject.Close(context.Background()))
+	assert.Eventually(t, func() bool {
+		return broker.message(t, "foxess/status").payload == "offline"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMQTTAvailabilityFollowsDeviceStatus(t *testing.T) {
+	t.Parallel()
+
+	broker := newBroker(t)
+	subject, err := sink.NewMQTT(mqttConfig(broker.url()), nil)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = subject.Close(context.Background()) })
+
+	online := foxess.Device{DeviceSerialNumber: "SN1", Status: foxess.StatusOnline}   //nolint:exhaustruct
+	offline := foxess.Device{DeviceSerialNumber: "SN1", Status: foxess.StatusOffline} //nolint:exhaustruct
+
+	require.NoError(t, subject.WriteDevices([]foxess.Device{online}))
+	require.NoError(t, subject.WriteDevices([]foxess.Device{online}))
+	require.NoError(t, subject.WriteDevices([]foxess.Device{offline}))
+
+	assert.Eventually(t, func() bool {
+		return broker.message(t, "foxess/SN1/availability").payload == "offline"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	count := 0
+
+	for _, topic := range broker.published() {
+		if topic == "foxess/SN1/availability" {
+			count++
+		}
+	}
+
+	assert.Equal(t, 2, count, "only changes of availability are published")
+}
+
+func TestMQTTWithoutDiscovery(t *testing.T) {
+	t.Parallel()
+
+	broker := newBroker(t)
+	config := mqttConfig(broker.url())
+	config.NoDiscovery = true
+	subject, err := sink.NewMQTT(config, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, subject.Write([]foxess.RealTimeData{realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 2})}))
+	require.NoError(t, subject.Close(context.Background()))
+
+	assert.Equal(t, "2", broker.message(t, "foxess/SN1/pvPower").payload)
+	assert.NotContains(t, broker.published(), "homeassistant/sensor/foxess_SN1/pvPower/config")
+}
+
+func TestMQTTDoesNotWaitForTheBroker(t *testing.T) {
+	t.Parallel()
+
+	broker := newBroker(t)
+	subject, err := sink.NewMQTT(mqttConfig(broker.url()), nil)
+	require.NoError(t, err)
+
+	broker.message(t, "foxess/status")
+	broker.stalled.Store(true)
+
+	start := time.Now()
+	require.NoError(t, subject.Write([]foxess.RealTimeData{realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 2})}))
+	assert.Less(t, time.Since(start), time.Second, "publishing is left to the background")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_ = subject.Close(ctx)
+}
+
+func TestMQTTAnnouncesAgainAfterDroppingDiscovery(t *testing.T) {
+	t.Parallel()
+
+	broker := newBroker(t)
+	config := mqttConfig(broker.url())
+	config.Timeout = 100 * time.Millisecond
+	subject, err := sink.NewMQTT(config, nil)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = subject.Close(context.Background()) })
+
+	broker.message(t, "foxess/status")
+	broker.stalled.Store(true)
+
+	// Fill the backlog while the broker stalls, so the discovery of SoC is dropped with the rest.
+	start := time.Now()
+	full := false
+
+	for i := 0; i < 1000 && !full; i++ {
+		full = subject.Write([]foxess.RealTimeData{realTimeData("SN1", start.Add(time.Duration(i)*time.Minute), map[string]float64{"pvPower": float64(i)})}) != nil
+	}
+
+	require.True(t, full, "the backlog never filled")
+	require.Error(t, subject.Write([]foxess.RealTimeData{realTimeData("SN1", start.Add(999*time.Minute), map[string]float64{"pvPower": 1, "SoC": 1})}))
+
+	broker.stalled.Store(false)
+
+	for i := 1000; ; i++ {
+		_ = subject.Write([]foxess.RealTimeData{realTimeData("SN1", start.Add(time.Duration(i)*time.Minute), map[string]float64{"pvPower": 1, "SoC": float64(i)})})
+
+		broker.mutex.Lock()
+		_, announced := broker.messages["homeassistant/sensor/foxess_SN1/SoC/config"]
+		broker.mutex.Unlock()
+
+		if announced {
+			break
+		}
+
+		require.Less(t, i, 2000, "SoC was never announced")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,196 @@
+package sink_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/sink"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an OTLP collector stand-in that records the resource metrics it receives.
+type collector struct {
+	collectorpb.UnimplementedMetricsServiceServer
+
+	mutex   sync.Mutex
+	metrics []*metricspb.ResourceMetrics
+	headers map[string][]string
+}
+
+func (c *collector) record(request *collectorpb.ExportMetricsServiceRequest, headers map[string][]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.metrics = append(c.metrics, request.GetResourceMetrics()...)
+	c.headers = headers
+}
+
+func (c *collector) Export(ctx context.Context, request *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	headers, _ := metadata.FromIncomingContext(ctx)
+	c.record(request, headers)
+
+	return &collectorpb.ExportMetricsServiceResponse{}, nil //nolint:exhaustruct
+}
+
+func (c *collector) received() ([]*metricspb.ResourceMetrics, map[string][]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.metrics, c.headers
+}
+
+func httpCollector(t *testing.T) (*collector, string) {
+	t.Helper()
+
+	c := &collector{} //nolint:exhaustruct
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		var request collectorpb.ExportMetricsServiceRequest
+		assert.NoError(t, proto.Unmarshal(body, &request))
+		c.record(&request, r.Header)
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	return c, server.URL
+}
+
+func grpcCollector(t *testing.T) (*collector, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	c := &collector{} //nolint:exhaustruct
+	server := grpc.NewServer()
+	collectorpb.RegisterMetricsServiceServer(server, c)
+
+	go func() { _ = server.Serve(listener) }()
+
+	t.Cleanup(server.Stop)
+
+	return c, "http://" + listener.Addr().String()
+}
+
+func otlpConfig(endpoint, protocol string) *sink.OTLPConfig {
+	return &sink.OTLPConfig{ //nolint:exhaustruct
+		Endpoint: endpoint,
+		Protocol: protocol,
+		Headers:  map[string]string{"x-api-key": "secret"},
+		Timeout:  5 * time.Second,
+	}
+}
+
+func attributes(resource *metricspb.ResourceMetrics) map[string]string {
+	result := make(map[string]string)
+	for _, attribute := range resource.GetResource().GetAttributes() {
+		result[attribute.GetKey()] = attribute.GetValue().GetStringValue()
+	}
+
+	return result
+}
+
+func exportAll(t *testing.T, subject *sink.OTLP, at time.Time) {
+	t.Helper()
+
+	require.NoError(t, subject.WriteDevices([]foxess.Device{
+		{DeviceSerialNumber: "SN1", StationID: "42", StationName: "Home", ProductType: "H1", Status: foxess.StatusOnline}, //nolint:exhaustruct
+	}))
+
+	data := realTimeData("SN1", at, map[string]float64{"pvPower": 1.5, "generation": 1234.5})
+	data.Variables[0].Unit = "kWh"
+	data.Variables[1].Unit = "kW"
+	require.NoError(t, subject.Write([]foxess.RealTimeData{data}))
+	require.NoError(t, subject.WriteQuota(&foxess.APIUsage{Total: 1440, Remaining: 1000, PercentageUsed: 30.5}))
+	require.NoError(t, subject.Close(context.Background()))
+}
+
+func TestOTLPExportsOverHTTP(t *testing.T) {
+	t.Parallel()
+
+	c, endpoint := httpCollector(t)
+	subject, err := sink.NewOTLP(context.Background(), otlpConfig(endpoint, sink.ProtocolHTTP), []string{"generation"})
+	require.NoError(t, err)
+
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	exportAll(t, subject, at)
+
+	resources, headers := c.received()
+	require.Len(t, resources, 3)
+	assert.Equal(t, []string{"secret"}, headers["X-Api-Key"])
+
+	assert.Equal(t, map[string]string{
+		"service.name":        "foxess-exporter",
+		"foxess.inverter":     "SN1",
+		"foxess.station.id":   "42",
+		"foxess.station.name": "Home",
+		"foxess.product_type": "H1",
+		"foxess.device_type":  "",
+	}, attributes(resources[1]))
+
+	metrics := make(map[string]*metricspb.Metric)
+
+	for _, resource := range resources {
+		for _, metric := range resource.GetScopeMetrics()[0].GetMetrics() {
+			metrics[metric.GetName()] = metric
+		}
+	}
+
+	assert.Equal(t, int64(foxess.StatusOnline), metrics["foxess.device.status"].GetGauge().GetDataPoints()[0].GetAsInt())
+
+	generation := metrics["foxess.realtime.generation"].GetSum()
+	require.NotNil(t, generation)
+	assert.True(t, generation.GetIsMonotonic())
+	assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, generation.GetAggregationTemporality())
+	assert.InDelta(t, 1234.5, generation.GetDataPoints()[0].GetAsDouble(), 0)
+	assert.Equal(t, "kWh", metrics["foxess.realtime.generation"].GetUnit())
+
+	pvPower := metrics["foxess.realtime.pvPower"].GetGauge()
+	require.NotNil(t, pvPower)
+	assert.Equal(t, uint64(at.UnixNano()), pvPower.GetDataPoints()[0].GetTimeUnixNano()) //nolint:gosec
+
+	assert.InDelta(t, 0.305, metrics["foxess.api.quota.used"].GetGauge().GetDataPoints()[0].GetAsDouble(), 1e-9)
+	assert.Equal(t, map[string]string{"service.name": "foxess-exporter"}, attributes(resources[2]))
+}
+
+func TestOTLPExportsOverGRPC(t *testing.T) {
+	t.Parallel()
+
+	c, endpoint := grpcCollector(t)
+	subject, err := sink.NewOTLP(context.Background(), otlpConfig(endpoint, sink.ProtocolGRPC), nil)
+	require.NoError(t, err)
+
+	exportAll(t, subject, time.Now())
+
+	resources, headers := c.received()
+	require.Len(t, resources, 3)
+	assert.Equal(t, []string{"secret"}, headers["x-api-key"])
+	assert.Equal(t, "SN1", attributes(resources[1])["foxess.inverter"])
+	assert.NotNil(t, resources[1].GetScopeMetrics()[0].GetMetrics()[0].GetGauge(), "not a counter")
+}
+
+func TestOTLPEndpointIsValidated(t *testing.T) {
+	t.Parallel()
+
+	_, err := sink.NewOTLP(context.Background(), otlpConfig("localhost", sink.ProtocolHTTP), nil)
+	require.ErrorIs(t, err, sink.ErrInvalidConfig)
+}
@@ -0,0 +1,230 @@
+package sink_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teh-hippo/foxess-exporter/foxess"
+	"github.com/teh-hippo/foxess-exporter/sink"
+)
+
+// receiver is a remote-write endpoint that responds with each status in turn, then 204.
+type receiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	writes   []*prompb.WriteRequest
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	t.Helper()
+
+	r := &receiver{mutex: sync.Mutex{}, statuses: statuses, requests: nil, writes: nil}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		assert.NoError(t, err)
+
+		decoded, err := snappy.Decode(nil, body)
+		assert.NoError(t, err)
+
+		var write prompb.WriteRequest
+		assert.NoError(t, proto.Unmarshal(decoded, &write))
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		r.requests = append(r.requests, request)
+
+		if len(r.statuses) > 0 {
+			status := r.statuses[0]
+			r.statuses = r.statuses[1:]
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte("rejected\n"))
+
+			return
+		}
+
+		r.writes = append(r.writes, &write)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	return r, server
+}
+
+func (r *receiver) received() ([]*http.Request, []*prompb.WriteRequest) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.requests, r.writes
+}
+
+func remoteWrite(t *testing.T, url string, batchSize int, dir string) *sink.RemoteWrite {
+	t.Helper()
+
+	subject, err := sink.NewRemoteWrite(&sink.RemoteWriteConfig{
+		URL:         url,
+		BatchSize:   batchSize,
+		HTTPConfig:  sink.HTTPConfig{BearerToken: "token", Timeout: time.Second}, //nolint:exhaustruct
+		QueueConfig: queueConfig(dir),
+	})
+	require.NoError(t, err)
+
+	return subject
+}
+
+func TestRemoteWriteBatchesNewSamples(t *testing.T) {
+	t.Parallel()
+
+	r, server := newReceiver(t)
+	subject := remoteWrite(t, server.URL, 2, "")
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	data := []foxess.RealTimeData{realTimeData("SN1", at, map[string]float64{"pvPower": 1.5, "SoC": 80, "loadsPower": 0.5})}
+	require.NoError(t, subject.Write(data))
+	// Unchanged data has already been sent.
+	require.NoError(t, subject.Write(data))
+	require.NoError(t, subject.Close(context.Background()))
+
+	requests, writes := r.received()
+	require.Len(t, writes, 2)
+	assert.Len(t, writes[0].Timeseries, 2)
+	assert.Len(t, writes[1].Timeseries, 1)
+	assert.Equal(t, "Bearer token", requests[0].Header.Get("Authorization"))
+	assert.Equal(t, "snappy", requests[0].Header.Get("Content-Encoding"))
+
+	series := writes[0].Timeseries[0]
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "foxess_realtime_data"}, //nolint:exhaustruct
+		{Name: "inverter", Value: "SN1"},                  //nolint:exhaustruct
+		{Name: "variable", Value: "SoC"},                  //nolint:exhaustruct
+	}, series.Labels)
+	assert.Equal(t, []prompb.Sample{{Value: 80, Timestamp: at.UnixMilli()}}, series.Samples) //nolint:exhaustruct
+}
+
+func TestRemoteWriteRetriesRecoverableFailures(t *testing.T) {
+	t.Parallel()
+
+	r, server := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	subject := remoteWrite(t, server.URL, 10, "")
+
+	require.NoError(t, subject.Write([]foxess.RealTimeData{realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 1})}))
+	require.NoError(t, subject.Close(context.Background()))
+
+	requests, writes := r.received()
+	assert.Len(t, requests, 3)
+	assert.Len(t, writes, 1)
+}
+
+func TestRemoteWriteDropsRejectedPayloads(t *testing.T) {
+	t.Parallel()
+
+	r, server := newReceiver(t, http.StatusBadRequest)
+	subject := remoteWrite(t, server.URL, 10, "")
+	now := time.Now()
+
+	require.NoError(t, subject.Write([]foxess.RealTimeData{realTimeData("SN1", now, map[string]float64{"pvPower": 1})}))
+	require.NoError(t, subject.Write([]foxess.RealTimeData{realTimeData("SN1", now.Add(time.Minute), map[string]float64{"pvPower": 2})}))
+	require.NoError(t, subject.Close(context.Background()))
+
+	requests, writes := r.received()
+	assert.Len(t, requests, 2)
+	require.Len(t, writes, 1)
+	assert.InDelta(t, 2.0, writes[0].Timeseries[0].Samples[0].Value, 0)
+}
+
+func TestRemoteWriteQueuesOnDiskDuringOutage(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	outage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(outage.Close)
+
+	subject := remoteWrite(t, outage.URL, 10, dir)
+	require.NoError(t, subject.Write([]foxess.RealTimeData{realTimeData("SN1", time.Now(), map[string]float64{"pvPower": 1})}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, subject.Close(ctx), sink.ErrDelivery)
+
+	// The queued payload is delivered once the endpoint recovers, after a restart.
+	r, server := newReceiver(t)
+	resumed := remoteWrite(t, server.URL, 10, dir)
+	require.NoError(t, resumed.Close(context.Background()))
+
+	_, writes := r.received()
+	require.Len(t, writes, 1)
+	assert.Equal(t, "pvPower", writes[0].Timeseries[0].Labels[2].Value)
+}
+
+func TestQueueDropsOldestWhenFull(t *testing.T) {
+	t.Parallel()
+
+	for _, dir := range []string{"", t.TempDir()} {
+		queue, err := sink.NewQueue(dir, 2)
+		require.NoError(t, err)
+
+		for _, payload := range []string{"a", "b", "c"} {
+			require.NoError(t, queue.Push([]byte(payload)))
+		}
+
+		assert.Equal(t, 2, queue.Len())
+
+		payload, position, ok := queue.Peek()
+		require.True(t, ok)
+		assert.Equal(t, "b", string(payload))
+
+		// Dropping the payload being delivered must not remove the next one once it is delivered.
+		require.NoError(t, queue.Push([]byte("d")))
+		queue.Pop(position)
+
+		payload, position, ok = queue.Peek()
+		require.True(t, ok)
+		assert.Equal(t, "c", string(payload))
+
+		queue.Pop(position)
+		_, position, _ = queue.Peek()
+		queue.Pop(position)
+
+		_, _, ok = queue.Peek()
+		assert.False(t, ok)
+	}
+}
+
+func TestHistoryTimeSeriesAreSortedAndOptionallyEnded(t *testing.T) {
+	t.Parallel()
+
+	at := time.UnixMilli(1_700_000_000_000)
+	histories := []foxess.InverterHistory{{DeviceSN: "SN1", Variables: []foxess.VariableHistory{
+		{Variable: "pvPower", Unit: "kW", Name: "PVPower", DataPoints: []foxess.DataPoint{
+			{Time: foxess.CustomTime{Time: at.Add(time.Minute)}, Value: foxess.NumberAsNil{Number: 2}},
+			{Time: foxess.CustomTime{Time: at}, Value: foxess.NumberAsNil{Number: 1}},
+		}},
+		{Variable: "SoC", Unit: "%", Name: "SoC", DataPoints: nil},
+	}}}
+
+	timeSeries := sink.HistoryTimeSeries(histories, false)
+	require.Len(t, timeSeries, 1)
+	assert.Equal(t, []prompb.Sample{
+		{Value: 1, Timestamp: at.UnixMilli()},                  //nolint:exhaustruct
+		{Value: 2, Timestamp: at.Add(time.Minute).UnixMilli()}, //nolint:exhaustruct
+	}, timeSeries[0].Samples)
+
+	timeSeries = sink.HistoryTimeSeries(histories, true)
+	require.Len(t, timeSeries[0].Samples, 3)
+	assert.True(t, value.IsStaleNaN(timeSeries[0].Samples[2].Value))
+	assert.Equal(t, at.Add(time.Minute).UnixMilli()+1, timeSeries[0].Samples[2].Timestamp)
+}
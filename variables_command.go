@@ -24,6 +24,10 @@ func (x *VariablesCommand) Register(parser *flags.Parser, config *foxess.Config)
 	x.config = config
 }
 
+func (x *VariablesCommand) RequiresAPIKey() bool {
+	return true
+}
+
 func (x *VariablesCommand) Execute(_ []string) error {
 	variables, err := x.config.GetVariables(x.GridOnly)
 	if err != nil {